@@ -0,0 +1,122 @@
+package goflyway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/coyove/goflyway/v"
+)
+
+type adminConn struct {
+	ConnInfo
+	Age  float64 `json:"age"`  // seconds since the tunnel started
+	Idle float64 `json:"idle"` // seconds since the last read or write
+}
+
+// AdminHandler serves the admin API of the server started by NewServer, every request must carry
+// "Authorization: Bearer <token>":
+//
+//	GET    /conns[?user=name]  list active tunnels, optionally of one user
+//	DELETE /conns/<id>         close a tunnel
+//	DELETE /conns?user=name    close all tunnels of a user
+//	GET    /traffic?unit=hour|day[&user=name][&host=pattern][&from=time][&to=time]
+//	                           query the ledger, times are in RFC 3339
+func (config *ServerConfig) AdminHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if config.live == nil {
+			http.Error(w, "server is not running", http.StatusServiceUnavailable)
+			return
+		}
+		conns := &config.live.conns
+
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		user, hasUser := r.URL.Query()["user"]
+
+		switch {
+		case path == "/conns" && r.Method == "GET":
+			now := time.Now()
+			list := []adminConn{}
+			for _, c := range conns.list() {
+				if hasUser && c.User != user[0] {
+					continue
+				}
+				list = append(list, adminConn{
+					ConnInfo: c,
+					Age:      now.Sub(c.Start).Seconds(),
+					Idle:     now.Sub(c.LastActive).Seconds(),
+				})
+			}
+			writeJSON(w, list)
+		case path == "/conns" && r.Method == "DELETE":
+			if !hasUser {
+				http.Error(w, "user is required", http.StatusBadRequest)
+				return
+			}
+			n := conns.closeWhere(func(c *ConnInfo) bool { return c.User == user[0] })
+			Vprint("admin: closed ", n, " tunnels of user ", strconv.Quote(user[0]))
+			writeJSON(w, map[string]int{"closed": n})
+		case strings.HasPrefix(path, "/conns/") && r.Method == "DELETE":
+			id, err := strconv.ParseUint(strings.TrimPrefix(path, "/conns/"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid id", http.StatusBadRequest)
+				return
+			}
+			if conns.closeWhere(func(c *ConnInfo) bool { return c.ID == id }) == 0 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			Vprint("admin: closed tunnel ", id)
+			writeJSON(w, map[string]int{"closed": 1})
+		case path == "/traffic" && r.Method == "GET":
+			ledger := config.live.current().Ledger
+			if ledger == nil {
+				http.Error(w, "ledger is not enabled", http.StatusNotFound)
+				return
+			}
+			q := LedgerQuery{Unit: r.FormValue("unit"), User: r.FormValue("user"), Host: r.FormValue("host")}
+			if q.Unit != "" && q.Unit != LedgerHour && q.Unit != LedgerDay {
+				http.Error(w, "invalid unit", http.StatusBadRequest)
+				return
+			}
+			for _, t := range []struct {
+				name string
+				v    *time.Time
+			}{{"from", &q.From}, {"to", &q.To}} {
+				if s := r.FormValue(t.name); s != "" {
+					tm, err := time.Parse(time.RFC3339, s)
+					if err != nil {
+						http.Error(w, "invalid "+t.name, http.StatusBadRequest)
+						return
+					}
+					*t.v = tm
+				}
+			}
+			writeJSON(w, ledger.Query(q))
+		case path == "/conns" || path == "/traffic" || strings.HasPrefix(path, "/conns/"):
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// AdminHandler serves the admin API, see ServerConfig.AdminHandler
+func (s *Server) AdminHandler(token string) http.Handler {
+	return s.config.AdminHandler(token)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
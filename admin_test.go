@@ -0,0 +1,82 @@
+package goflyway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type closeFlag struct{ closed bool }
+
+func (c *closeFlag) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestAdminHandler(t *testing.T) {
+	config := &ServerConfig{live: &liveServer{}}
+	config.live.config.Store(config)
+
+	conns := []*closeFlag{{}, {}, {}}
+	for i, user := range []string{"", "alice", "alice"} {
+		config.live.conns.add(conns[i])
+		config.live.conns.describe(conns[i], &ConnInfo{User: user, Start: time.Now()})
+	}
+
+	ts := httptest.NewServer(config.AdminHandler("tok"))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		method, path, token string
+		code                int
+		body                string // users of the listed tunnels, or the response
+		closed              []bool
+	}{
+		{"GET", "/conns", "", 401, "", nil},
+		{"GET", "/conns", "bad", 401, "", nil},
+		{"GET", "/conns", "tok", 200, ",alice,alice", nil},
+		{"GET", "/conns?user=alice", "tok", 200, "alice,alice", nil},
+		{"GET", "/conns?user=bob", "tok", 200, "", nil},
+		{"DELETE", "/conns/4", "tok", 404, "", nil},
+		{"DELETE", "/conns/x", "tok", 400, "", nil},
+		{"DELETE", "/conns/1", "tok", 200, `{"closed":1}`, []bool{true, false, false}},
+		{"DELETE", "/conns", "tok", 400, "", nil},
+		{"DELETE", "/conns?user=alice", "tok", 200, `{"closed":2}`, []bool{true, true, true}},
+		{"PUT", "/conns", "tok", 405, "", nil},
+	} {
+		req, _ := http.NewRequest(c.method, ts.URL+c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body := strings.TrimSpace(string(buf))
+		if c.method == "GET" && resp.StatusCode == 200 {
+			var list []adminConn
+			json.Unmarshal(buf, &list)
+			var users []string
+			for _, c := range list {
+				users = append(users, c.User)
+			}
+			body = strings.Join(users, ",")
+		}
+
+		if resp.StatusCode != c.code || c.code == 200 && body != c.body {
+			t.Fatal(c.method, c.path, resp.StatusCode, body)
+		}
+		for i, closed := range c.closed {
+			if conns[i].closed != closed {
+				t.Fatal(c.method, c.path, i, conns[i].closed)
+			}
+		}
+	}
+}
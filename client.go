@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/coyove/goflyway/toh"
 	"github.com/coyove/goflyway/v"
@@ -18,49 +21,214 @@ import (
 type ClientConfig struct {
 	commonConfig
 	Upstream    string
+	Upstreams   []Upstream
+	Balance     string
+	HealthCheck time.Duration
 	Bind        string
 	URLHeader   string
 	PathPattern string
 	WebSocket   bool
+	Protocol    string
 	VPN         bool
 	Dynamic     bool
+	Forwards    []Forward
+
+	MaxIdleConns   int
+	MaxActiveConns int
+	MaxInflight    int
+	UploadWindow   int // concurrent uploads of a tunnel in HTTP mode
+
+	live *liveClient
 }
 
-func NewClient(localaddr string, config *ClientConfig) error {
+// liveClient holds the config and upstreams of a running client, they can be swapped by Reload
+type liveClient struct {
+	state     atomic.Value // *clientState
+	listeners closerSet    // local listeners and reverse control connections
+	conns     closerSet    // local connections being forwarded
+	shaper    shaper
+	done      chan bool
+}
+
+type clientState struct {
+	config    *ClientConfig
+	upstreams *upstreamPool
+}
+
+func (l *liveClient) load() (*ClientConfig, *upstreamPool) {
+	s := l.state.Load().(*clientState)
+	return s.config, s.upstreams
+}
+
+func (config *ClientConfig) start() *liveClient {
 	config.check()
+	config.live = &liveClient{done: make(chan bool)}
+	config.live.state.Store(&clientState{config: config, upstreams: config.newUpstreamPool()})
+	return config.live
+}
+
+func (config *ClientConfig) validate() error {
+	if config.Upstream == "" && len(config.Upstreams) == 0 {
+		return fmt.Errorf("no upstreams")
+	}
+
+	switch config.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConn, BalanceLatency:
+	default:
+		return fmt.Errorf("unknown balance strategy: %q", config.Balance)
+	}
+
+	if config.Protocol != "" && toh.LookupTransport(config.Protocol) == nil {
+		return fmt.Errorf("unknown transport: %q", config.Protocol)
+	}
+	for _, u := range config.Upstreams {
+		if u.Protocol != "" && toh.LookupTransport(u.Protocol) == nil {
+			return fmt.Errorf("unknown transport: %q", u.Protocol)
+		}
+	}
+	return config.Shaping.check()
+}
+
+// Reload applies newConfig to the client started by NewClient (or NewReverseClient),
+// new connections will use the new upstreams and settings while existing ones keep running.
+// Forwards can't be changed without restarting, the running client is not affected if newConfig is invalid
+func (config *ClientConfig) Reload(newConfig *ClientConfig) error {
+	if config.live == nil {
+		return fmt.Errorf("client is not running")
+	}
+	if err := newConfig.validate(); err != nil {
+		return err
+	}
+
+	old, oldUpstreams := config.live.load()
+	if !reflect.DeepEqual(old.Forwards, newConfig.Forwards) {
+		v.Eprint("forwards can't be reloaded, restart to apply")
+	}
 
-	tr := *http.DefaultTransport.(*http.Transport)
+	newConfig.check()
+	if newConfig.Stat == nil {
+		newConfig.Stat = old.Stat
+	}
+	if newConfig.Ledger == nil {
+		newConfig.Ledger = old.Ledger
+	}
+	newConfig.live = config.live
+
+	config.live.state.Store(&clientState{config: newConfig, upstreams: newConfig.newUpstreamPool()})
+	oldUpstreams.stop()
+	return nil
+}
+
+func (config *ClientConfig) newUpstreamPool() *upstreamPool {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
 	if config.VPN {
 		tr.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
 			return vpnDial(address)
 		}
 	}
 
-	dialer := toh.NewDialer(config.Key, config.Upstream,
-		toh.WithWebSocket(config.WebSocket),
-		toh.WithInactiveTimeout(config.Timeout),
-		toh.WithTransport(&tr),
-		toh.WithMaxWriteBuffer(int(config.WriteBuffer)),
-		toh.WithHeader(config.URLHeader))
+	return newUpstreamPool(config, tr)
+}
 
-	mux, err := net.Listen("tcp", localaddr)
-	if err != nil {
+// Forward describes a port forwarding:
+//
+//	static:  connections to Local are forwarded to Remote
+//	dynamic: Local is a SOCKS5 server, connections are forwarded to the requested destinations
+//	reverse: the server listens on Remote, connections there are forwarded to Local
+type Forward struct {
+	Local   string `json:"local"`
+	Remote  string `json:"remote"`
+	Dynamic bool   `json:"dynamic"`
+	Reverse bool   `json:"reverse"`
+}
+
+func (f Forward) String() string {
+	switch {
+	case f.Reverse:
+		return "reverse " + f.Remote + " -> " + f.Local
+	case f.Dynamic:
+		return "dynamic " + f.Local + " -> *"
+	default:
+		return f.Local + " -> " + f.Remote
+	}
+}
+
+// NewClient serves localaddr (if not empty, using config.Bind and config.Dynamic)
+// and all forwards in config.Forwards through the same upstreams
+func NewClient(localaddr string, config *ClientConfig) error {
+	return NewClientContext(context.Background(), localaddr, config)
+}
+
+// NewClientContext serves until ctx is done, then it closes all local listeners,
+// waits config.DrainTimeout for active tunnels to finish and closes the rest.
+// It returns nil if all tunnels finished in time
+func NewClientContext(ctx context.Context, localaddr string, config *ClientConfig) error {
+	c := NewClientHandle(localaddr, config)
+	if err := c.Start(); err != nil {
 		return err
 	}
 
+	select {
+	case err := <-c.errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	config, _ = config.live.load()
+	dctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	return c.Shutdown(dctx)
+}
+
+// stop closes all listeners and stops health checks, active tunnels are not affected
+func (live *liveClient) stop() {
+	close(live.done)
+	live.listeners.closeAll()
+
+	_, upstreams := live.load()
+	upstreams.stop()
+}
+
+func (live *liveClient) listen(f Forward) (net.Listener, error) {
+	mux, err := net.Listen("tcp", f.Local)
+	if err != nil {
+		return nil, err
+	}
+	if !live.listeners.add(mux) {
+		mux.Close()
+		return nil, fmt.Errorf("client is closed")
+	}
+	return mux, nil
+}
+
+func (live *liveClient) serveForward(mux net.Listener, f Forward) error {
 	for {
 		conn, err := mux.Accept()
 		if err != nil {
-			return err
+			select {
+			case <-live.done:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if !live.conns.add(conn) {
+			conn.Close()
+			continue
 		}
 
 		go func(conn net.Conn) {
+			config, upstreams := live.load()
 			downconn := toh.NewBufConn(conn)
-			defer conn.Close()
+			defer func() {
+				conn.Close()
+				live.conns.remove(conn)
+			}()
 
-			var bind = config.Bind
+			var bind = f.Remote
 
-			if config.Dynamic {
+			if f.Dynamic {
 				dst, err := handleSOCKS5(downconn)
 				if err != nil {
 					v.Eprint("SOCKS5 server error: ", err)
@@ -70,7 +238,7 @@ func NewClient(localaddr string, config *ClientConfig) error {
 				v.Vprint("SOCKS5 destination: ", dst)
 			}
 
-			up, err := dialer.Dial()
+			up, err := upstreams.Dial()
 
 			if err != nil {
 				v.Eprint("dial server: ", err)
@@ -78,28 +246,40 @@ func NewClient(localaddr string, config *ClientConfig) error {
 			}
 			defer up.Close()
 
-			upconn := toh.NewBufConn(up)
-			if _, err := upconn.Write([]byte(bind + "\n")); err != nil {
-				v.Eprint("failed to req: ", err)
-				return
-			}
-
-			resp, err := upconn.ReadBytes('\n')
-			if err != nil || string(resp) != "OK\n" {
-				v.Eprint("server failed to ack: ", err, ", resp: ", string(resp))
+			upconn, err := handshake(up, bind)
+			if err != nil {
+				v.Eprint(err)
 				return
 			}
 
-			if config.Dynamic {
+			if f.Dynamic {
 				// SOCKS5 OK response
 				downconn.Write([]byte{0x05, 0, 0, 1, 0, 0, 0, 0, 0, 0})
 			}
 
-			Bridge(upconn, downconn, nil, config.Stat)
+			info := &ConnInfo{Local: conn.RemoteAddr().String(), Remote: bind, Start: time.Now()}
+			live.conns.describe(conn, info)
+
+			upbks, downbks := live.shaper.buckets(&config.Shaping, "")
+			bridge(upconn, newCountedConn(downconn, info, config.Ledger), config.Stat, nil, upbks, downbks)
 		}(conn)
 	}
 }
 
+// handshake asks the goflyway server on the other side of up to connect to bind
+func handshake(up net.Conn, bind string) (*toh.BufConn, error) {
+	upconn := toh.NewBufConn(up)
+	if _, err := upconn.Write([]byte(bind + "\n")); err != nil {
+		return nil, fmt.Errorf("failed to req: %v", err)
+	}
+
+	resp, err := upconn.ReadBytes('\n')
+	if err != nil || string(resp) != "OK\n" {
+		return nil, fmt.Errorf("server failed to ack: %v, resp: %s", err, strings.TrimSpace(string(resp)))
+	}
+	return upconn, nil
+}
+
 func handleSOCKS5(conn net.Conn) (string, error) {
 	buf := make([]byte, 256)
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
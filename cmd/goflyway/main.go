@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
@@ -12,26 +13,34 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/coyove/common/sched"
 	"github.com/coyove/goflyway"
+	"github.com/coyove/goflyway/toh"
 	"github.com/coyove/goflyway/v"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
 	version      = "__devel__"
-	remoteAddr   string
-	localAddr    string
+	forwards     []goflyway.Forward
+	hops         []goflyway.Hop // from -J, -w applies to them only
 	addr         string
 	httpsProxy   string
 	resetTraffic bool
+	configPath   string
+	metricsAddr  string
+	adminAddr    string
+	adminToken   string
+	ledgerPath   string
 	cconfig      = &goflyway.ClientConfig{}
 	sconfig      = &goflyway.ServerConfig{}
 )
@@ -41,7 +50,7 @@ func printHelp(a ...interface{}) {
 		fmt.Printf("goflyway: ")
 		fmt.Println(a...)
 	}
-	fmt.Println("usage: goflyway -DLhHUvkqpPtTwWy address:port")
+	fmt.Println("usage: goflyway -ABDGJLMRhHUvkqpPtTwWXy address:port[,address:port...]")
 	os.Exit(0)
 }
 
@@ -66,7 +75,7 @@ func main() {
 					printHelp()
 				//case 'V':
 				//	printHelp(version)
-				case 'L', 'P', 'p', 'k', 't', 'T', 'W', 'H', 'U', 'D', 'c':
+				case 'L', 'R', 'G', 'P', 'p', 'k', 't', 'T', 'W', 'H', 'U', 'D', 'c', 'B', 'J', 'X', 'M', 'A':
 					last = c
 				case 'v':
 					v.Verbose++
@@ -96,26 +105,56 @@ func main() {
 			}
 		}
 		switch last {
-		case 'D':
-			cconfig.Dynamic = true
-			fallthrough
-		case 'L':
+		case 'D', 'L':
+			f := goflyway.Forward{Dynamic: last == 'D'}
 			switch parts := strings.Split(p, ":"); len(parts) {
 			case 1:
-				localAddr = ":" + parts[0]
+				f.Local = ":" + parts[0]
 			case 2:
-				localAddr = p
+				f.Local = p
 			case 3:
-				localAddr, remoteAddr = ":"+parts[0], parts[1]+":"+parts[2]
+				f.Local, f.Remote = ":"+parts[0], parts[1]+":"+parts[2]
 			case 4:
-				localAddr, remoteAddr = parts[0]+":"+parts[1], parts[2]+":"+parts[3]
+				f.Local, f.Remote = parts[0]+":"+parts[1], parts[2]+":"+parts[3]
 			default:
 				printHelp("illegal option --", string(last), p)
 			}
+			forwards = append(forwards, f)
+		case 'R':
+			f := goflyway.Forward{Reverse: true}
+			switch parts := strings.Split(p, ":"); len(parts) {
+			case 3:
+				f.Remote, f.Local = ":"+parts[0], parts[1]+":"+parts[2]
+			case 4:
+				f.Remote, f.Local = parts[0]+":"+parts[1], parts[2]+":"+parts[3]
+			default:
+				printHelp("illegal option --", string(last), p)
+			}
+			forwards = append(forwards, f)
+		case 'G':
+			sconfig.ReverseBinds = append(sconfig.ReverseBinds, p)
 		case 'P':
 			sconfig.ProxyPassAddr = p
 		case 'U':
 			cconfig.PathPattern = p
+		case 'B':
+			cconfig.Balance = p
+		case 'M':
+			metricsAddr = p
+		case 'A':
+			ledgerPath = p
+		case 'J':
+			hop := goflyway.Hop{Match: []string{"*"}, Upstream: p}
+			if idx := strings.LastIndex(p, "="); idx > -1 {
+				hop.Match, hop.Upstream = strings.Split(p[:idx], ","), p[idx+1:]
+			}
+			hops = append(hops, hop)
+		case 'X':
+			proxy := goflyway.OutboundProxy{URL: p}
+			if idx := strings.Index(p, "="); idx > -1 && idx < strings.Index(p, "://") {
+				proxy.Match, proxy.URL = strings.Split(p[:idx], ","), p[idx+1:]
+			}
+			sconfig.Proxies = append(sconfig.Proxies, proxy)
 		case 'T':
 			speed, _ := strconv.ParseInt(p, 10, 64)
 			sconfig.SpeedThrot = goflyway.NewTokenBucket(speed, speed*25)
@@ -134,6 +173,13 @@ func main() {
 			buf, _ := ioutil.ReadFile(p)
 			cmds := make(map[string]interface{})
 			json.Unmarshal(buf, &cmds)
+			if _, ok := cmds["server_port"]; !ok {
+				loadConfig(p)
+				configPath = p
+				break
+			}
+
+			// shadowsocks plugin config
 			cconfig.Key, cconfig.VPN = cmds["password"].(string), true
 			addr = fmt.Sprintf("%v:%v", cmds["server"], cmds["server_port"])
 
@@ -146,7 +192,7 @@ func main() {
 	}
 
 	if addr == "" {
-		if localAddr == "" {
+		if len(forwards) == 0 {
 			v.Vprint("assume you want a default server at :8100")
 			addr = ":8100"
 		} else {
@@ -154,27 +200,36 @@ func main() {
 		}
 	}
 
-	if localAddr != "" && remoteAddr == "" {
-		_, port, err1 := net.SplitHostPort(localAddr)
-		host, _, err2 := net.SplitHostPort(addr)
-		remoteAddr = host + ":" + port
-		if err1 != nil || err2 != nil {
-			printHelp("invalid address --", localAddr, addr)
+	for i, f := range forwards {
+		if f.Remote == "" && !f.Dynamic {
+			_, port, err1 := net.SplitHostPort(f.Local)
+			host, _, err2 := net.SplitHostPort(strings.Split(addr, ",")[0])
+			forwards[i].Remote = host + ":" + port
+			if err1 != nil || err2 != nil {
+				printHelp("invalid address --", f.Local, addr)
+			}
 		}
 	}
 
-	if localAddr != "" && remoteAddr != "" {
-		cconfig.Bind = remoteAddr
+	if len(forwards) > 0 {
+		cconfig.Forwards = forwards
 		cconfig.Upstream = addr
+		if addrs := strings.Split(addr, ","); len(addrs) > 1 {
+			for _, a := range addrs {
+				cconfig.Upstreams = append(cconfig.Upstreams, goflyway.Upstream{Addr: a, WebSocket: cconfig.WebSocket})
+			}
+			v.Vprint("upstreams: ", addrs, ", balance: ", cconfig.Balance)
+		}
 		cconfig.Stat = &goflyway.Traffic{}
+		cconfig.Ledger = openLedger()
+		defer cconfig.Ledger.Close()
+		serveMetrics(cconfig.Stat)
 
 		if v.Verbose > 0 {
 			go watchTraffic(cconfig, resetTraffic)
 		}
-		if cconfig.Dynamic {
-			v.Vprint("dynamic: forward ", localAddr, " to * through ", addr)
-		} else {
-			v.Vprint("forward ", localAddr, " to ", remoteAddr, " through ", addr)
+		for _, f := range forwards {
+			v.Vprint("forward ", f, " through ", addr)
 		}
 		if cconfig.WebSocket {
 			v.Vprint("relay: use Websocket protocol")
@@ -186,7 +241,12 @@ func main() {
 			v.Vprint("note: system HTTPS proxy is set to: ", a)
 		}
 
-		v.Eprint(goflyway.NewClient(localAddr, cconfig))
+		if configPath != "" {
+			go reloadOnSignal(configPath)
+		}
+		if err := goflyway.NewClientContext(shutdownContext(), "", cconfig); err != nil {
+			v.Eprint(err)
+		}
 	} else if httpsProxy != "" {
 		v.Vprint("server listen on ", addr, " (https://", httpsProxy, ")")
 		m := &autocert.Manager{
@@ -214,7 +274,147 @@ func main() {
 		}
 	} else {
 		v.Vprint("server listen on ", addr)
-		v.Eprint(goflyway.NewServer(addr, sconfig))
+		sconfig.Stat = &goflyway.Traffic{}
+		sconfig.Ledger = openLedger()
+		defer sconfig.Ledger.Close()
+		serveMetrics(sconfig.Stat)
+		serveAdmin(sconfig)
+		for _, hop := range hops {
+			hop.WebSocket = cconfig.WebSocket
+			sconfig.Hops = append(sconfig.Hops, hop)
+		}
+		for i := range sconfig.Hops {
+			v.Vprint("forward ", sconfig.Hops[i].Match, " through ", sconfig.Hops[i].Upstream)
+		}
+		for _, p := range sconfig.Proxies {
+			v.Vprint("outbound proxy ", p.URL, " for ", p.Match)
+		}
+		if configPath != "" {
+			go reloadOnSignal(configPath)
+		}
+		if err := goflyway.NewServerContext(shutdownContext(), addr, sconfig); err != nil {
+			v.Eprint(err)
+		}
+	}
+}
+
+func loadConfig(path string) {
+	config, err := goflyway.LoadConfig(path)
+	if err != nil {
+		v.Eprint(err)
+		os.Exit(1)
+	}
+
+	if config.Verbose != 0 {
+		v.Verbose = config.Verbose
+	}
+	if config.Metrics != "" {
+		metricsAddr = config.Metrics
+	}
+	toh.SetWriteBudget(config.WriteBudget)
+	if config.Ledger != "" {
+		ledgerPath = config.Ledger
+	}
+
+	if c := config.ClientConfig(); c != nil {
+		cconfig, forwards = c, c.Forwards
+		addr = c.Upstream
+	} else {
+		sconfig = config.ServerConfig()
+		addr = config.Server.Listen
+		adminAddr, adminToken = config.Server.Admin.Listen, config.Server.Admin.Token
+	}
+}
+
+func serveMetrics(stat *goflyway.Traffic) {
+	if metricsAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", goflyway.MetricsHandler(stat))
+	v.Vprint("metrics at http://", metricsAddr, "/metrics")
+
+	go func() {
+		v.Eprint("metrics: ", http.ListenAndServe(metricsAddr, mux))
+	}()
+}
+
+func openLedger() *goflyway.Ledger {
+	if ledgerPath == "" {
+		return nil
+	}
+
+	l, err := goflyway.OpenLedger(ledgerPath)
+	if err != nil {
+		v.Eprint("ledger: ", err)
+		os.Exit(1)
+	}
+	v.Vprint("account traffic to ", ledgerPath)
+	return l
+}
+
+func serveAdmin(sconfig *goflyway.ServerConfig) {
+	if adminAddr == "" {
+		return
+	}
+
+	v.Vprint("admin API at http://", adminAddr, "/conns")
+	go func() {
+		v.Eprint("admin: ", http.ListenAndServe(adminAddr, sconfig.AdminHandler(adminToken)))
+	}()
+}
+
+// shutdownContext is cancelled on SIGTERM or SIGINT to shut down gracefully, the second signal exits immediately
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		<-sig
+		v.Vprint("shutting down, waiting for active tunnels, signal again to quit now")
+		cancel()
+		<-sig
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// reloadOnSignal reloads the config file into the running client or server when asked by the system,
+// only settings in the file are reloaded, command line flags are not applied again
+func reloadOnSignal(path string) {
+	sig := make(chan os.Signal, 1)
+	notifyReload(sig)
+
+	for range sig {
+		config, err := goflyway.LoadConfig(path)
+		if err != nil {
+			v.Eprint("reload: ", err, ", keep running with the old config")
+			continue
+		}
+
+		switch c, s := config.ClientConfig(), config.ServerConfig(); {
+		case c != nil && len(forwards) > 0:
+			err = cconfig.Reload(c)
+		case s != nil && len(forwards) == 0:
+			if config.Server.Listen != addr {
+				v.Eprint("reload: listen address can't be changed, restart to apply")
+			}
+			err = sconfig.Reload(s)
+		default:
+			err = fmt.Errorf("can't switch between client and server")
+		}
+
+		if err != nil {
+			v.Eprint("reload: ", err, ", keep running with the old config")
+			continue
+		}
+		if config.Verbose != 0 {
+			v.Verbose = config.Verbose
+		}
+		toh.SetWriteBudget(config.WriteBudget)
+		v.Vprint("reload: ", path, " applied")
 	}
 }
 
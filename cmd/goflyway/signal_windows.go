@@ -0,0 +1,9 @@
+// +build windows
+
+package main
+
+import "os"
+
+// Windows has no SIGHUP, config can't be reloaded
+func notifyReload(c chan os.Signal) {
+}
@@ -0,0 +1,495 @@
+package goflyway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/goflyway/toh"
+)
+
+// Config is the configuration file of goflyway, written in JSON:
+//
+//	{
+//	  "key": "password",
+//	  "timeout": "15s",
+//	  "client": {
+//	    "upstreams": [{"addr": "server1:80"}, {"addr": "server2:80", "websocket": true}],
+//	    "forwards": [{"local": ":1080", "dynamic": true}, {"local": ":8080", "remote": "host:80"}]
+//	  }
+//	}
+type Config struct {
+	Key          string   `json:"key"`
+	Timeout      Duration `json:"timeout"`
+	DrainTimeout Duration `json:"drain_timeout"`
+	WriteBuffer  int64    `json:"write_buffer"`
+	WriteBudget  int64    `json:"write_budget"` // bytes in write buffers of all connections, see toh.SetWriteBudget
+	Verbose      int      `json:"verbose"`
+	Metrics      string   `json:"metrics"` // address to serve Prometheus metrics at /metrics
+	Ledger       string   `json:"ledger"`  // file to save traffic accounted by user and destination
+	Shaping      Shaping  `json:"shaping"`
+
+	Client *ClientFileConfig `json:"client"`
+	Server *ServerFileConfig `json:"server"`
+}
+
+type ClientFileConfig struct {
+	Upstreams      []Upstream `json:"upstreams"`
+	Balance        string     `json:"balance"`
+	HealthCheck    Duration   `json:"health_check"`
+	Forwards       []Forward  `json:"forwards"`
+	WebSocket      bool       `json:"websocket"`
+	Protocol       string     `json:"protocol"`
+	URLHeader      string     `json:"url_header"`
+	PathPattern    string     `json:"path_pattern"`
+	MaxIdleConns   int        `json:"max_idle_conns"`
+	MaxActiveConns int        `json:"max_active_conns"`
+	MaxInflight    int        `json:"max_inflight"`
+	UploadWindow   int        `json:"upload_window"`
+}
+
+type ServerFileConfig struct {
+	Listen    string            `json:"listen"`
+	ProxyPass string            `json:"proxy_pass"`
+	Throttle  int64             `json:"throttle"` // bytes per second
+	Hops      []Hop             `json:"hops"`
+	Proxies   []OutboundProxy   `json:"proxies"`
+	ACL       ACL               `json:"acl"`
+	Users     map[string]string `json:"users"`  // user -> key
+	Quotas    map[string]Quota  `json:"quotas"` // user -> quota, "" for the key
+	Limits    toh.Limits        `json:"limits"`
+	Admin     AdminFileConfig   `json:"admin"`
+
+	TrustedProxies []string `json:"trusted_proxies"` // IPs or CIDRs
+	ReverseBinds   []string `json:"reverse_binds"`   // addresses clients can listen on besides loopback
+}
+
+func (c *ServerFileConfig) users() map[string]string {
+	if c == nil {
+		return nil
+	}
+	return c.Users
+}
+
+// AdminFileConfig enables the admin API at Listen, see ServerConfig.AdminHandler
+type AdminFileConfig struct {
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+}
+
+// Duration accepts both Go duration strings ("1m30s") and numbers of seconds
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	if s, err := strconv.Unquote(string(b)); err == nil {
+		x, err := time.ParseDuration(s)
+		*d = Duration(x)
+		return err
+	}
+
+	sec, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return fmt.Errorf("invalid duration: %s", b)
+	}
+	*d = Duration(sec * float64(time.Second))
+	return nil
+}
+
+type ConfigError struct {
+	Key string
+	Msg string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Key == "" {
+		return "config: " + e.Msg
+	}
+	return "config: " + e.Key + ": " + e.Msg
+}
+
+func LoadConfig(path string) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(buf)
+}
+
+func ParseConfig(buf []byte) (*Config, error) {
+	var raw interface{}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(buf[:se.Offset], []byte("\n"))
+			return nil, &ConfigError{Msg: fmt.Sprintf("line %d: %v", line, err)}
+		}
+		return nil, &ConfigError{Msg: err.Error()}
+	}
+
+	if err := checkKeys("", raw, reflect.TypeOf(Config{})); err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := json.Unmarshal(buf, c); err != nil {
+		if te, ok := err.(*json.UnmarshalTypeError); ok {
+			// Newer Go versions report slice indexes as "a.0.b", make it "a[0].b"
+			key := regexp.MustCompile(`\.(\d+)\b`).ReplaceAllString(te.Field, "[$1]")
+			return nil, &ConfigError{Key: key, Msg: "expect " + te.Type.String() + ", got " + te.Value}
+		}
+		return nil, &ConfigError{Msg: err.Error()}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkKeys walks the raw JSON value and reports the first key which doesn't exist in t
+// or the first malformed duration, so the error can point to the offending key
+func checkKeys(path string, raw interface{}, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(Duration(0)) {
+		var d Duration
+		b, _ := json.Marshal(raw)
+		if err := d.UnmarshalJSON(b); err != nil {
+			return &ConfigError{Key: path, Msg: err.Error()}
+		}
+		return nil
+	}
+
+	switch raw := raw.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+				fields[tag] = t.Field(i).Type
+			}
+		}
+
+		keys := make([]string, 0, len(raw))
+		for k := range raw {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			key := k
+			if path != "" {
+				key = path + "." + k
+			}
+			ft, ok := fields[k]
+			if !ok {
+				return &ConfigError{Key: key, Msg: "unknown key"}
+			}
+			if err := checkKeys(key, raw[k], ft); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, v := range raw {
+			if err := checkKeys(fmt.Sprintf("%s[%d]", path, i), v, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkAddr(key, addr string) error {
+	if addr == "" {
+		return &ConfigError{Key: key, Msg: "missing address"}
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return &ConfigError{Key: key, Msg: fmt.Sprintf("invalid address %q", addr)}
+	}
+	return nil
+}
+
+func checkPatterns(key string, patterns []string) error {
+	for i, p := range patterns {
+		if p == "" {
+			return &ConfigError{Key: fmt.Sprintf("%s[%d]", key, i), Msg: "empty pattern"}
+		}
+		if strings.Contains(p, "/") {
+			if _, _, err := net.ParseCIDR(p); err != nil {
+				return &ConfigError{Key: fmt.Sprintf("%s[%d]", key, i), Msg: err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Timeout < 0 {
+		return &ConfigError{Key: "timeout", Msg: "must not be negative"}
+	}
+	if c.DrainTimeout < 0 {
+		return &ConfigError{Key: "drain_timeout", Msg: "must not be negative"}
+	}
+	if c.WriteBuffer < 0 {
+		return &ConfigError{Key: "write_buffer", Msg: "must not be negative"}
+	}
+	if c.WriteBudget < 0 {
+		return &ConfigError{Key: "write_budget", Msg: "must not be negative"}
+	}
+	if c.Metrics != "" {
+		if err := checkAddr("metrics", c.Metrics); err != nil {
+			return err
+		}
+	}
+	if err := c.Shaping.check(); err != nil {
+		return &ConfigError{Key: "shaping", Msg: err.Error()}
+	}
+	for user := range c.Shaping.Users {
+		if _, ok := c.Server.users()[user]; !ok && user != "" {
+			return &ConfigError{Key: "shaping.users." + user, Msg: "unknown user"}
+		}
+	}
+
+	switch {
+	case c.Client == nil && c.Server == nil:
+		return &ConfigError{Msg: "either client or server should be set"}
+	case c.Client != nil && c.Server != nil:
+		return &ConfigError{Key: "server", Msg: "client and server can't be both set"}
+	case c.Client != nil:
+		return c.Client.validate()
+	default:
+		return c.Server.validate()
+	}
+}
+
+func (c *ClientFileConfig) validate() error {
+	if len(c.Upstreams) == 0 {
+		return &ConfigError{Key: "client.upstreams", Msg: "at least one upstream is required"}
+	}
+	for i, u := range c.Upstreams {
+		key := fmt.Sprintf("client.upstreams[%d]", i)
+		if err := checkAddr(key+".addr", u.Addr); err != nil {
+			return err
+		}
+		if u.Protocol != "" && toh.LookupTransport(u.Protocol) == nil {
+			return &ConfigError{Key: key + ".protocol", Msg: fmt.Sprintf("unknown transport %q", u.Protocol)}
+		}
+	}
+
+	switch c.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConn, BalanceLatency:
+	default:
+		return &ConfigError{Key: "client.balance", Msg: fmt.Sprintf("unknown strategy %q", c.Balance)}
+	}
+
+	if c.Protocol != "" && toh.LookupTransport(c.Protocol) == nil {
+		return &ConfigError{Key: "client.protocol", Msg: fmt.Sprintf("unknown transport %q", c.Protocol)}
+	}
+
+	if len(c.Forwards) == 0 {
+		return &ConfigError{Key: "client.forwards", Msg: "at least one forward is required"}
+	}
+	for i, f := range c.Forwards {
+		key := fmt.Sprintf("client.forwards[%d]", i)
+		if f.Dynamic && f.Reverse {
+			return &ConfigError{Key: key, Msg: "can't be both dynamic and reverse"}
+		}
+		if err := checkAddr(key+".local", f.Local); err != nil {
+			return err
+		}
+		if !f.Dynamic {
+			if err := checkAddr(key+".remote", f.Remote); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, n := range []struct {
+		key string
+		n   int
+	}{
+		{"client.max_idle_conns", c.MaxIdleConns},
+		{"client.max_active_conns", c.MaxActiveConns},
+		{"client.max_inflight", c.MaxInflight},
+		{"client.upload_window", c.UploadWindow},
+	} {
+		if n.n < 0 {
+			return &ConfigError{Key: n.key, Msg: "must not be negative"}
+		}
+	}
+	return nil
+}
+
+func (c *ServerFileConfig) validate() error {
+	if err := checkAddr("server.listen", c.Listen); err != nil {
+		return err
+	}
+	if c.Throttle < 0 {
+		return &ConfigError{Key: "server.throttle", Msg: "must not be negative"}
+	}
+
+	for i, hop := range c.Hops {
+		key := fmt.Sprintf("server.hops[%d]", i)
+		if err := checkAddr(key+".upstream", hop.Upstream); err != nil {
+			return err
+		}
+		if len(hop.Match) == 0 {
+			return &ConfigError{Key: key + ".match", Msg: "at least one pattern is required"}
+		}
+		if err := checkPatterns(key+".match", hop.Match); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.Proxies {
+		key := fmt.Sprintf("server.proxies[%d]", i)
+		p := c.Proxies[i]
+		if err := p.check(); err != nil {
+			return &ConfigError{Key: key + ".url", Msg: err.Error()}
+		}
+		if err := checkPatterns(key+".match", p.Match); err != nil {
+			return err
+		}
+		if err := checkPatterns(key+".bypass", p.Bypass); err != nil {
+			return err
+		}
+	}
+
+	if err := checkPatterns("server.acl.allow", c.ACL.Allow); err != nil {
+		return err
+	}
+	if err := checkPatterns("server.acl.deny", c.ACL.Deny); err != nil {
+		return err
+	}
+	if err := checkPatterns("server.reverse_binds", c.ReverseBinds); err != nil {
+		return err
+	}
+
+	users := make([]string, 0, len(c.Users))
+	for user := range c.Users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	keys := map[string]string{}
+	for _, user := range users {
+		key := "server.users." + user
+		switch u, dup := keys[c.Users[user]]; {
+		case user == "":
+			return &ConfigError{Key: "server.users", Msg: "empty user name"}
+		case c.Users[user] == "":
+			return &ConfigError{Key: key, Msg: "missing key"}
+		case dup:
+			return &ConfigError{Key: key, Msg: fmt.Sprintf("same key as user %q", u)}
+		}
+		keys[c.Users[user]] = user
+	}
+
+	if err := c.Limits.Validate(); err != nil {
+		return &ConfigError{Key: "server.limits", Msg: err.Error()}
+	}
+
+	for i, p := range c.TrustedProxies {
+		if _, err := parseNets([]string{p}); err != nil {
+			return &ConfigError{Key: fmt.Sprintf("server.trusted_proxies[%d]", i), Msg: err.Error()}
+		}
+	}
+
+	for user, q := range c.Quotas {
+		if q.Daily < 0 || q.Monthly < 0 {
+			return &ConfigError{Key: "server.quotas." + user, Msg: "must not be negative"}
+		}
+		if _, ok := c.Users[user]; !ok && user != "" {
+			return &ConfigError{Key: "server.quotas." + user, Msg: "unknown user"}
+		}
+	}
+
+	if c.Admin.Listen != "" {
+		if err := checkAddr("server.admin.listen", c.Admin.Listen); err != nil {
+			return err
+		}
+		if c.Admin.Token == "" {
+			return &ConfigError{Key: "server.admin.token", Msg: "token is required"}
+		}
+	}
+	return nil
+}
+
+func (c *Config) common() commonConfig {
+	return commonConfig{
+		Key:          c.Key,
+		Timeout:      time.Duration(c.Timeout),
+		DrainTimeout: time.Duration(c.DrainTimeout),
+		WriteBuffer:  c.WriteBuffer,
+		Shaping:      c.Shaping,
+	}
+}
+
+// ClientConfig returns the client part of the config, nil if not presented
+func (c *Config) ClientConfig() *ClientConfig {
+	if c.Client == nil {
+		return nil
+	}
+
+	cc := c.Client
+	ups := append([]Upstream{}, cc.Upstreams...)
+	for i := range ups {
+		ups[i].WebSocket = ups[i].WebSocket || cc.WebSocket
+	}
+
+	return &ClientConfig{
+		commonConfig:   c.common(),
+		Upstream:       ups[0].Addr,
+		Upstreams:      ups,
+		Balance:        cc.Balance,
+		HealthCheck:    time.Duration(cc.HealthCheck),
+		Forwards:       cc.Forwards,
+		WebSocket:      cc.WebSocket,
+		Protocol:       cc.Protocol,
+		URLHeader:      cc.URLHeader,
+		PathPattern:    cc.PathPattern,
+		MaxIdleConns:   cc.MaxIdleConns,
+		MaxActiveConns: cc.MaxActiveConns,
+		MaxInflight:    cc.MaxInflight,
+		UploadWindow:   cc.UploadWindow,
+	}
+}
+
+// ServerConfig returns the server part of the config, nil if not presented
+func (c *Config) ServerConfig() *ServerConfig {
+	if c.Server == nil {
+		return nil
+	}
+
+	sc := &ServerConfig{
+		commonConfig:  c.common(),
+		ProxyPassAddr: c.Server.ProxyPass,
+		Hops:          c.Server.Hops,
+		Proxies:       c.Server.Proxies,
+		ACL:           c.Server.ACL,
+		Users:         c.Server.Users,
+		Quotas:        c.Server.Quotas,
+		Limits:        c.Server.Limits,
+
+		TrustedProxies: c.Server.TrustedProxies,
+		ReverseBinds:   c.Server.ReverseBinds,
+	}
+	if c.Server.Throttle > 0 {
+		sc.SpeedThrot = NewTokenBucket(c.Server.Throttle, c.Server.Throttle*25)
+	}
+	return sc
+}
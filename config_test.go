@@ -0,0 +1,61 @@
+package goflyway
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(`{
+		"key": "password",
+		"timeout": "20s",
+		"client": {
+			"upstreams": [{"addr": "a:80"}, {"addr": "b:80", "key": "b"}],
+			"balance": "latency",
+			"health_check": 5,
+			"forwards": [{"local": ":1080", "dynamic": true}, {"local": ":8080", "remote": "host:80"}]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc := c.ClientConfig()
+	if cc.Timeout != 20*time.Second || cc.HealthCheck != 5*time.Second || len(cc.Upstreams) != 2 || len(cc.Forwards) != 2 {
+		t.Fatal(cc)
+	}
+	if c.ServerConfig() != nil {
+		t.Fatal("unexpected server config")
+	}
+
+	for conf, key := range map[string]string{
+		`{"server": {"listen": ":80", "acl": {"deny": ["10.0.0.0/33"]}}}`:              "server.acl.deny[0]",
+		`{"server": {"listen": ":80", "hops": [{"upstream": "a:80", "matc": ["*"]}]}}`: "server.hops[0].matc",
+		`{"server": {"listen": "80"}}`:                                                 "server.listen",
+		`{"server": {"listen": ":80", "proxies": [{"url": "ftp://a"}]}}`:               "server.proxies[0].url",
+		`{"timeout": "1x", "server": {"listen": ":80"}}`:                               "timeout",
+		`{"server": {"listen": ":80", "users": {"a": "k", "b": "k"}}}`:                 "server.users.b",
+		`{"server": {"listen": ":80", "quotas": {"a": {"daily": 1}}}}`:                 "server.quotas.a",
+		`{"shaping": {"users": {"a": {"upload": 1}}}, "server": {"listen": ":80"}}`:    "shaping.users.a",
+		`{"server": {"listen": ":80", "limits": {"max_conns": -1}}}`:                   "server.limits",
+		`{"server": {"listen": ":80", "trusted_proxies": ["10.0.0.1", "x"]}}`:          "server.trusted_proxies[1]",
+		`{"server": {"listen": ":80", "reverse_binds": ["10.0.0.0/33"]}}`:              "server.reverse_binds[0]",
+		`{"server": {"listen": ":80", "admin": {"listen": ":81"}}}`:                    "server.admin.token",
+		`{"client": {"upstreams": [{"addr": "a:80"}], "forwards": [{"local": ":1"}]}}`: "client.forwards[0].remote",
+		`{"client": {"upstreams": [{"addr": "a:80"}], "balance": "random"}}`:           "client.balance",
+	} {
+		_, err := ParseConfig([]byte(conf))
+		if ce, ok := err.(*ConfigError); !ok || ce.Key != key {
+			t.Fatal(conf, err)
+		}
+	}
+
+	if _, err := ParseConfig([]byte(`{"client": {"upstreams": [{"addr": 80}]}}`)); err == nil || !strings.Contains(err.Error(), "client.upstreams") {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseConfig([]byte("{\n\"key\": \"a\",\n}")); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,342 @@
+package goflyway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/toh"
+	. "github.com/coyove/goflyway/v"
+)
+
+// Stats is a snapshot of the traffic of a running client or server
+type Stats struct {
+	Sent   int64 // bytes sent to destinations
+	Recv   int64 // bytes received from destinations
+	Active int   // number of active tunnels
+}
+
+// ConnInfo describes an active tunnel
+type ConnInfo struct {
+	ID         uint64    `json:"id"`
+	Conn       string    `json:"conn,omitempty"` // index of the toh connection, server only
+	User       string    `json:"user,omitempty"` // user of the key the client connected with, server only
+	Local      string    `json:"local"`          // the side which started the tunnel
+	Remote     string    `json:"remote"`         // destination of the tunnel
+	Start      time.Time `json:"start"`
+	LastActive time.Time `json:"last_active"`
+	Sent       int64     `json:"sent"`
+	Recv       int64     `json:"recv"`
+	Buffered   int       `json:"buffered"` // bytes waiting to be sent to the other side of the toh connection
+
+	active int64 // unix nanoseconds
+	conn   net.Conn
+}
+
+func (info *ConnInfo) snapshot() ConnInfo {
+	// counters are updated atomically, don't copy the struct as a whole
+	c := ConnInfo{
+		ID:     info.ID,
+		Conn:   info.Conn,
+		User:   info.User,
+		Local:  info.Local,
+		Remote: info.Remote,
+		Start:  info.Start,
+		Sent:   atomic.LoadInt64(&info.Sent),
+		Recv:   atomic.LoadInt64(&info.Recv),
+	}
+	c.LastActive = c.Start
+	if a := atomic.LoadInt64(&info.active); a > 0 {
+		c.LastActive = time.Unix(0, a)
+	}
+	if b, ok := info.conn.(interface{ Buffered() int }); ok {
+		c.Buffered = b.Buffered()
+	}
+	return c
+}
+
+// ledgerFlushInterval is how often an active countedConn adds its counts to the ledger
+var ledgerFlushInterval = time.Second
+
+// countedConn counts bytes read from and written to the local side of a tunnel
+// and accounts them in the ledger if there is one. The ledger is shared by all tunnels,
+// so counts are added to it in batches and the rest on Close
+type countedConn struct {
+	net.Conn
+	info    *ConnInfo
+	ledger  *Ledger
+	sent    int64 // not added to the ledger yet
+	recv    int64
+	flushed int64 // unix nanoseconds of the last flush
+}
+
+func newCountedConn(conn net.Conn, info *ConnInfo, ledger *Ledger) *countedConn {
+	ledger.Add(info.User, info.Remote, 0, 0, 1)
+	return &countedConn{Conn: conn, info: info, ledger: ledger, flushed: time.Now().UnixNano()}
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.count(&c.info.Sent, &c.sent, n)
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.count(&c.info.Recv, &c.recv, n)
+	return n, err
+}
+
+func (c *countedConn) count(total, unflushed *int64, n int) {
+	now := time.Now().UnixNano()
+	atomic.AddInt64(total, int64(n))
+	atomic.StoreInt64(&c.info.active, now)
+	if n == 0 || c.ledger == nil {
+		return
+	}
+	atomic.AddInt64(unflushed, int64(n))
+	if last := atomic.LoadInt64(&c.flushed); now-last >= int64(ledgerFlushInterval) && atomic.CompareAndSwapInt64(&c.flushed, last, now) {
+		c.flush()
+	}
+}
+
+func (c *countedConn) flush() {
+	if sent, recv := atomic.SwapInt64(&c.sent, 0), atomic.SwapInt64(&c.recv, 0); sent > 0 || recv > 0 {
+		c.ledger.Add(c.info.User, c.info.Remote, sent, recv, 0)
+	}
+}
+
+func (c *countedConn) Close() error {
+	err := c.Conn.Close()
+	c.flush()
+	return err
+}
+
+func (c *countedConn) CloseWrite() error {
+	return toh.CloseWrite(c.Conn)
+}
+
+func statsOf(stat *Traffic, conns *closerSet) Stats {
+	return Stats{
+		Sent:   atomic.LoadInt64(stat.Sent()),
+		Recv:   atomic.LoadInt64(stat.Recv()),
+		Active: len(conns.list()),
+	}
+}
+
+// Server is a goflyway server which can be started and shut down by its owner:
+//
+//	s := goflyway.NewServerHandle(":8100", &goflyway.ServerConfig{...})
+//	if err := s.Start(); err != nil {
+//		...
+//	}
+//	defer s.Shutdown(ctx)
+type Server struct {
+	listen string
+	config *ServerConfig
+
+	done     chan bool
+	err      error
+	shutdown sync.Once
+	drainErr error
+}
+
+func NewServerHandle(listen string, config *ServerConfig) *Server {
+	return &Server{listen: listen, config: config, done: make(chan bool)}
+}
+
+// Start listens and serves in background
+func (s *Server) Start() error {
+	config := s.config
+	rp, err := config.prepare()
+	if err != nil {
+		return err
+	}
+
+	listener, err := toh.Listen(config.Key, s.listen, rp...)
+	if err != nil {
+		return err
+	}
+
+	if config.Stat == nil {
+		config.Stat = &Traffic{}
+	}
+	config.reverse = &reverseTable{}
+	config.live = &liveServer{ln: listener.(*toh.Listener)}
+	config.live.ln.SetUsers(config.Users)
+	config.live.config.Store(config)
+
+	go func() {
+		defer close(s.done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				s.err = err
+				return
+			}
+
+			go config.live.current().serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops accepting new connections and waits for active tunnels to finish,
+// remaining ones will be closed when ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.config.live == nil {
+		return fmt.Errorf("server is not running")
+	}
+
+	s.shutdown.Do(func() {
+		Vprint("server shutting down, draining active tunnels")
+		s.drainErr = s.config.live.ln.Shutdown(ctx)
+		<-s.done
+		s.config.live.current().closeHops()
+	})
+	return s.drainErr
+}
+
+// Reload applies newConfig to new connections, see ServerConfig.Reload
+func (s *Server) Reload(newConfig *ServerConfig) error {
+	return s.config.Reload(newConfig)
+}
+
+func (s *Server) Addr() net.Addr {
+	if s.config.live == nil {
+		return nil
+	}
+	return s.config.live.ln.Addr()
+}
+
+func (s *Server) Stats() Stats {
+	if s.config.live == nil {
+		return Stats{}
+	}
+	return statsOf(s.config.live.current().Stat, &s.config.live.conns)
+}
+
+// Conns returns active tunnels ordered by their start time
+func (s *Server) Conns() []ConnInfo {
+	if s.config.live == nil {
+		return nil
+	}
+	return s.config.live.conns.list()
+}
+
+// Client is a goflyway client which can be started and shut down by its owner, see Server
+type Client struct {
+	localaddr string
+	config    *ClientConfig
+
+	addrs    []net.Addr
+	errs     chan error
+	shutdown sync.Once
+	drainErr error
+}
+
+// NewClientHandle creates a client serving localaddr (if not empty, using config.Bind and config.Dynamic)
+// and all forwards in config.Forwards
+func NewClientHandle(localaddr string, config *ClientConfig) *Client {
+	return &Client{localaddr: localaddr, config: config}
+}
+
+// Start listens on all local addresses and serves in background
+func (c *Client) Start() error {
+	config := c.config
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	forwards := config.Forwards
+	if c.localaddr != "" {
+		forwards = append([]Forward{{Local: c.localaddr, Remote: config.Bind, Dynamic: config.Dynamic}}, forwards...)
+	}
+	if len(forwards) == 0 {
+		return fmt.Errorf("no forwards to serve")
+	}
+
+	if config.Stat == nil {
+		config.Stat = &Traffic{}
+	}
+	live := config.start()
+
+	muxes := make([]net.Listener, len(forwards))
+	for i, f := range forwards {
+		if f.Reverse {
+			continue
+		}
+
+		mux, err := live.listen(f)
+		if err != nil {
+			live.stop()
+			return err
+		}
+		muxes[i] = mux
+		c.addrs = append(c.addrs, mux.Addr())
+	}
+
+	c.errs = make(chan error, len(forwards))
+	for i, f := range forwards {
+		go func(mux net.Listener, f Forward) {
+			if f.Reverse {
+				c.errs <- live.forwardReverse(f)
+			} else {
+				c.errs <- live.serveForward(mux, f)
+			}
+		}(muxes[i], f)
+	}
+	return nil
+}
+
+// Shutdown closes all local listeners and waits for active tunnels to finish,
+// remaining ones will be closed when ctx is done
+func (c *Client) Shutdown(ctx context.Context) error {
+	if c.config.live == nil {
+		return fmt.Errorf("client is not running")
+	}
+
+	c.shutdown.Do(func() {
+		Vprint("client shutting down, draining active tunnels")
+		c.config.live.stop()
+		c.drainErr = c.config.live.conns.drain(ctx)
+	})
+	return c.drainErr
+}
+
+// Reload applies newConfig to new connections, see ClientConfig.Reload
+func (c *Client) Reload(newConfig *ClientConfig) error {
+	return c.config.Reload(newConfig)
+}
+
+// Addr returns the address of the first local listener, nil if there is none
+func (c *Client) Addr() net.Addr {
+	if len(c.addrs) == 0 {
+		return nil
+	}
+	return c.addrs[0]
+}
+
+// Addrs returns addresses of all local listeners in the order of forwards, reverse ones are excluded
+func (c *Client) Addrs() []net.Addr {
+	return c.addrs
+}
+
+func (c *Client) Stats() Stats {
+	if c.config.live == nil {
+		return Stats{}
+	}
+	config, _ := c.config.live.load()
+	return statsOf(config.Stat, &c.config.live.conns)
+}
+
+// Conns returns active tunnels ordered by their start time
+func (c *Client) Conns() []ConnInfo {
+	if c.config.live == nil {
+		return nil
+	}
+	return c.config.live.conns.list()
+}
@@ -0,0 +1,97 @@
+package goflyway
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func echoListener(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(conn, conn); conn.Close() }()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestHandles(t *testing.T) {
+	echo := echoListener(t)
+	s := NewServerHandle("127.0.0.1:0", &ServerConfig{commonConfig: commonConfig{Key: "k"}})
+	c := NewClientHandle("127.0.0.1:0", &ClientConfig{commonConfig: commonConfig{Key: "k"}, Bind: echo})
+	if s.Addr() != nil || c.Addr() != nil || s.Conns() != nil || c.Conns() != nil || s.Stats() != (Stats{}) || c.Stats() != (Stats{}) {
+		t.Fatal("handles should be empty before Start")
+	}
+	if s.Shutdown(context.Background()) == nil || c.Shutdown(context.Background()) == nil {
+		t.Fatal("handles can't be shut down before Start")
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.config.Upstream = s.Addr().String()
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var conn net.Conn
+	for _, step := range []struct {
+		name   string
+		do     func() error
+		active int
+		bytes  int64
+	}{
+		{"idle", func() error { return nil }, 0, 0},
+		{"echo", func() (err error) {
+			if conn, err = net.Dial("tcp", c.Addr().String()); err != nil {
+				return err
+			}
+			conn.Write([]byte("hello"))
+			_, err = io.ReadFull(conn, make([]byte, 5))
+			return err
+		}, 1, 5},
+		{"closed", func() error { return conn.Close() }, 0, 5},
+	} {
+		if err := step.do(); err != nil {
+			t.Fatal(step.name, err)
+		}
+
+		var ss, cs Stats
+		for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(20 * time.Millisecond) {
+			if ss, cs = s.Stats(), c.Stats(); ss.Active == step.active && cs.Active == step.active && cs.Sent == step.bytes {
+				break
+			}
+		}
+		if ss.Active != step.active || cs.Active != step.active || cs.Sent != step.bytes || cs.Recv != step.bytes {
+			t.Fatal(step.name, ss, cs)
+		}
+		if sc, cc := s.Conns(), c.Conns(); len(sc) != step.active || len(cc) != step.active {
+			t.Fatal(step.name, sc, cc)
+		} else if step.active > 0 && (cc[0].Remote != echo || cc[0].Sent != step.bytes || sc[0].Recv != step.bytes) {
+			t.Fatal(step.name, sc[0], cc[0])
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", c.Addr().String()); err == nil {
+		t.Fatal("client is still listening")
+	}
+}
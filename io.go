@@ -1,40 +1,71 @@
 package goflyway
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync/atomic"
 
+	"github.com/coyove/goflyway/toh"
 	. "github.com/coyove/goflyway/v"
 )
 
 func Bridge(target, source net.Conn, timeout *TokenBucket, stat *Traffic) {
-	go func() {
-		if err := ioCopy(target, source, timeout, stat.Sent()); err != nil {
+	bks := []*TokenBucket{timeout}
+	bridge(target, source, stat, nil, bks, bks)
+}
+
+// bridge is Bridge which stops when the quota is exceeded,
+// data from source to target wait for buckets in up, the other direction waits for down.
+// When one direction reaches EOF, its destination is half-closed if possible and the other
+// direction goes on, otherwise both sides are closed
+func bridge(target, source net.Conn, stat *Traffic, q *quota, up, down []*TokenBucket) {
+	// cancelled when the tunnel ends, so the other direction won't wait for buckets any more
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	end := func(dst net.Conn, err error) {
+		if err == io.EOF && toh.CloseWrite(dst) == nil {
+			return
+		}
+		if err != nil && err != io.EOF {
 			Eprint("bridge: ", err)
 		}
+		cancel()
 		target.Close()
 		source.Close()
+	}
+
+	done := make(chan bool)
+	go func() {
+		end(target, ioCopy(ctx, target, source, up, stat.Sent(), q))
+		close(done)
 	}()
 
-	if err := ioCopy(source, target, timeout, stat.Recv()); err != nil {
-		Eprint("bridge: ", err)
-	}
+	end(source, ioCopy(ctx, source, target, down, stat.Recv(), q))
+	<-done
 
 	// Multiple closes, but for tohConn they are just fine
 	target.Close()
 	source.Close()
 }
 
-func ioCopy(dst io.WriteCloser, src io.ReadCloser, bk *TokenBucket, bytes *int64) (err error) {
+// ioCopy returns io.EOF if src reaches EOF, errors of closed conns and timeouts are ignored
+func ioCopy(ctx context.Context, dst io.WriteCloser, src io.ReadCloser, bks []*TokenBucket, bytes *int64, q *quota) (err error) {
 	buf := make([]byte, 32*1024)
 
 	for {
 		nr, er := src.Read(buf)
 
 		if nr > 0 {
-			if bk != nil {
-				bk.Consume(int64(nr))
+			if err = q.use(int64(nr)); err != nil {
+				break
+			}
+
+			for _, bk := range bks {
+				if bk != nil && bk.WaitN(ctx, int64(nr)) != nil {
+					return nil
+				}
 			}
 
 			nw, ew := dst.Write(buf[0:nr])
@@ -57,7 +88,7 @@ func ioCopy(dst io.WriteCloser, src io.ReadCloser, bk *TokenBucket, bytes *int64
 		}
 
 		if er != nil {
-			if er != io.EOF && !isClosedConnErr(er) && !isTimeoutErr(er) {
+			if er == io.EOF || !isClosedConnErr(er) && !isTimeoutErr(er) {
 				err = er
 			}
 			break
@@ -0,0 +1,241 @@
+package goflyway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/coyove/goflyway/v"
+)
+
+const (
+	LedgerHour = "hour"
+	LedgerDay  = "day"
+)
+
+// LedgerEntry is the traffic of a user to a destination host in an hour or a day
+type LedgerEntry struct {
+	Unit   string    `json:"unit"`   // LedgerHour or LedgerDay
+	Period time.Time `json:"period"` // start of the period in UTC
+	User   string    `json:"user,omitempty"`
+	Host   string    `json:"host"`
+	Sent   int64     `json:"sent"`
+	Recv   int64     `json:"recv"`
+	Conns  int64     `json:"conns"`
+}
+
+type ledgerKey struct {
+	unit       string
+	period     int64
+	user, host string
+}
+
+// Ledger accounts traffic by user and destination host, rolled up hourly and daily.
+// If it has a path, it is saved there every minute and when closed
+type Ledger struct {
+	HourlyRetention time.Duration // default 7 days
+	DailyRetention  time.Duration // default 400 days
+
+	path    string
+	mu      sync.Mutex
+	entries map[ledgerKey]*LedgerEntry
+	dirty   bool
+	done    chan bool
+	once    sync.Once
+	savemu  sync.Mutex
+}
+
+type ledgerFile struct {
+	Entries []LedgerEntry `json:"entries"`
+}
+
+// OpenLedger loads the ledger saved at path, a missing file results in an empty ledger.
+// Empty path means the ledger is kept in memory only
+func OpenLedger(path string) (*Ledger, error) {
+	l := &Ledger{
+		HourlyRetention: 7 * 24 * time.Hour,
+		DailyRetention:  400 * 24 * time.Hour,
+		path:            path,
+		entries:         map[ledgerKey]*LedgerEntry{},
+		done:            make(chan bool),
+	}
+
+	if path == "" {
+		return l, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(buf) > 0 {
+		var f ledgerFile
+		if err := json.Unmarshal(buf, &f); err != nil {
+			return nil, err
+		}
+		for i := range f.Entries {
+			e := &f.Entries[i]
+			l.entries[ledgerKey{e.Unit, e.Period.Unix(), e.User, e.Host}] = e
+		}
+	}
+
+	go func() {
+		for tick := time.NewTicker(time.Minute); ; {
+			select {
+			case <-tick.C:
+				if err := l.Save(); err != nil {
+					Eprint("ledger: ", err)
+				}
+			case <-l.done:
+				tick.Stop()
+				return
+			}
+		}
+	}()
+	return l, nil
+}
+
+// Add accounts traffic of user to host (with or without port) at this moment
+func (l *Ledger) Add(user, host string, sent, recv, conns int64) {
+	if l == nil {
+		return
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	now := time.Now().UTC()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, unit := range []string{LedgerHour, LedgerDay} {
+		period := now.Truncate(time.Hour)
+		if unit == LedgerDay {
+			period = now.Truncate(24 * time.Hour)
+		}
+
+		k := ledgerKey{unit, period.Unix(), user, host}
+		e := l.entries[k]
+		if e == nil {
+			e = &LedgerEntry{Unit: unit, Period: period, User: user, Host: host}
+			l.entries[k] = e
+		}
+		e.Sent += sent
+		e.Recv += recv
+		e.Conns += conns
+	}
+	l.dirty = true
+}
+
+// LedgerQuery selects entries of Unit, empty fields match everything,
+// Host can be a pattern like the ones in ACL
+type LedgerQuery struct {
+	Unit string
+	User string
+	Host string
+	From time.Time // inclusive
+	To   time.Time // exclusive
+}
+
+// Query returns matched entries ordered by period, user and host
+func (l *Ledger) Query(q LedgerQuery) []LedgerEntry {
+	if q.Unit == "" {
+		q.Unit = LedgerHour
+	}
+
+	l.mu.Lock()
+	res := []LedgerEntry{}
+	for _, e := range l.entries {
+		switch {
+		case e.Unit != q.Unit,
+			q.User != "" && e.User != q.User,
+			q.Host != "" && !matchHost(q.Host, e.Host),
+			!q.From.IsZero() && e.Period.Before(q.From),
+			!q.To.IsZero() && !e.Period.Before(q.To):
+			continue
+		}
+		res = append(res, *e)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if !a.Period.Equal(b.Period) {
+			return a.Period.Before(b.Period)
+		}
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		return a.Host < b.Host
+	})
+	return res
+}
+
+// prune removes entries older than their retention
+func (l *Ledger) prune(now time.Time) {
+	for k, e := range l.entries {
+		r := l.HourlyRetention
+		if e.Unit == LedgerDay {
+			r = l.DailyRetention
+		}
+		if r > 0 && now.Sub(e.Period) > r {
+			delete(l.entries, k)
+			l.dirty = true
+		}
+	}
+}
+
+// Save prunes expired entries and writes the ledger to its path if it has been changed,
+// the file is replaced atomically so a crash never leaves a partial ledger
+func (l *Ledger) Save() error {
+	l.savemu.Lock()
+	defer l.savemu.Unlock()
+
+	l.mu.Lock()
+	l.prune(time.Now())
+	if l.path == "" || !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	f := ledgerFile{Entries: make([]LedgerEntry, 0, len(l.entries))}
+	for _, e := range l.entries {
+		f.Entries = append(f.Entries, *e)
+	}
+	l.dirty = false
+	l.mu.Unlock()
+
+	buf, _ := json.Marshal(f)
+	tmp := l.path + ".tmp"
+	fh, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(buf); err == nil {
+		err = fh.Sync()
+	}
+	if err1 := fh.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+	}
+	return err
+}
+
+// Close stops saving periodically and saves the ledger for the last time
+func (l *Ledger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.once.Do(func() { close(l.done) })
+	return l.Save()
+}
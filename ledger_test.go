@@ -0,0 +1,128 @@
+package goflyway
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedgerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	l, err := OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Add("alice", "a.example.com:443", 10, 20, 1)
+	l.Add("alice", "a.example.com:80", 1, 2, 1)
+	l.Add("", "b.example.com", 5, 0, 1)
+
+	old := time.Now().UTC().Add(-30 * 24 * time.Hour).Truncate(time.Hour)
+	l.mu.Lock()
+	l.entries[ledgerKey{LedgerHour, old.Unix(), "alice", "old"}] = &LedgerEntry{Unit: LedgerHour, Period: old, User: "alice", Host: "old", Sent: 1}
+	l.entries[ledgerKey{LedgerDay, old.Unix(), "alice", "old"}] = &LedgerEntry{Unit: LedgerDay, Period: old, User: "alice", Host: "old", Sent: 1}
+	l.mu.Unlock()
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary file is left", err)
+	}
+
+	l, err = OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, c := range []struct {
+		q     LedgerQuery
+		hosts []string
+		sent  int64
+	}{
+		{LedgerQuery{}, []string{"b.example.com", "a.example.com"}, 16},
+		{LedgerQuery{User: "alice"}, []string{"a.example.com"}, 11},
+		{LedgerQuery{Host: "*.example.com"}, []string{"b.example.com", "a.example.com"}, 16},
+		{LedgerQuery{Unit: LedgerDay, User: "alice"}, []string{"old", "a.example.com"}, 12},
+		{LedgerQuery{Unit: LedgerDay, From: old.Add(time.Hour)}, []string{"b.example.com", "a.example.com"}, 16},
+		{LedgerQuery{Unit: LedgerDay, To: old.Add(time.Hour)}, []string{"old"}, 1},
+	} {
+		res, sent := l.Query(c.q), int64(0)
+		if len(res) != len(c.hosts) {
+			t.Fatal(c.q, res)
+		}
+		for i, e := range res {
+			if e.Host != c.hosts[i] {
+				t.Fatal(c.q, res)
+			}
+			sent += e.Sent
+		}
+		if sent != c.sent {
+			t.Fatal(c.q, res)
+		}
+	}
+
+	if e := l.Query(LedgerQuery{User: "alice"})[0]; e.Recv != 22 || e.Conns != 2 || !e.Period.Equal(time.Now().UTC().Truncate(time.Hour)) {
+		t.Fatal(e)
+	}
+}
+
+func TestLedgerOpen(t *testing.T) {
+	dir := t.TempDir()
+	if l, err := OpenLedger(filepath.Join(dir, "missing.json")); err != nil || len(l.Query(LedgerQuery{})) != 0 {
+		t.Fatal(err)
+	} else {
+		l.Close()
+		if _, err := os.Stat(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+			t.Fatal("unchanged ledger should not be saved", err)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	ioutil.WriteFile(bad, []byte("{"), 0644)
+	if _, err := OpenLedger(bad); err == nil {
+		t.Fatal("corrupted ledger should fail")
+	}
+}
+
+func TestLedgerCountedConn(t *testing.T) {
+	defer func(d time.Duration) { ledgerFlushInterval = d }(ledgerFlushInterval)
+	ledgerFlushInterval = 100 * time.Millisecond
+
+	l, err := OpenLedger(filepath.Join(t.TempDir(), "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	a, b := net.Pipe()
+	go func() {
+		b.Write([]byte("ab"))
+		io.Copy(ioutil.Discard, b)
+	}()
+	info := &ConnInfo{User: "alice", Remote: "a.example.com:443"}
+	c := newCountedConn(a, info, l)
+
+	for _, step := range []struct {
+		name       string
+		do         func()
+		sent, recv int64 // in the ledger
+	}{
+		{"batched", func() { io.ReadFull(c, make([]byte, 2)); c.Write([]byte("xyz")) }, 0, 0},
+		{"flushed", func() { time.Sleep(ledgerFlushInterval); c.Write([]byte("x")) }, 2, 4},
+		{"closed", func() { c.Write([]byte("x")); c.Close() }, 2, 5},
+	} {
+		step.do()
+		e := l.Query(LedgerQuery{User: "alice"})[0]
+		if e.Sent != step.sent || e.Recv != step.recv || e.Conns != 1 {
+			t.Fatal(step.name, e)
+		}
+	}
+	if info.Sent != 2 || info.Recv != 5 {
+		t.Fatal(info.Sent, info.Recv)
+	}
+}
@@ -0,0 +1,57 @@
+package goflyway
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/coyove/goflyway/toh"
+)
+
+// MetricsHandler serves statistics of toh connections, and traffic of tunnels if stat is not nil,
+// in Prometheus text format
+func MetricsHandler(stat *Traffic) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, stat)
+	})
+}
+
+func WriteMetrics(w io.Writer, stat *Traffic) {
+	m := toh.Metrics()
+
+	metric := func(name, typ, help string, values ...interface{}) {
+		fmt.Fprintf(w, "# HELP goflyway_%s %s\n# TYPE goflyway_%s %s\n", name, help, name, typ)
+		for i := 0; i < len(values); i += 2 {
+			fmt.Fprintf(w, "goflyway_%s%s %v\n", name, values[i], values[i+1])
+		}
+	}
+
+	metric("client_conns", "gauge", "Active client side toh connections.", "", m.ClientConns)
+	metric("server_conns", "gauge", "Active server side toh connections.", "", m.ServerConns)
+	metric("frame_bytes_total", "counter", "Payload bytes in frames.",
+		`{direction="sent"}`, m.BytesSent, `{direction="recv"}`, m.BytesRecv)
+	metric("frames_total", "counter", "Frames with payload.",
+		`{direction="sent"}`, m.FramesSent, `{direction="recv"}`, m.FramesRecv)
+	metric("orch_pings_total", "counter", "Connections pinged in batch by orchestrators.", "", m.OrchPings)
+	metric("orch_directs_total", "counter", "Connections sent directly by orchestrators.", "", m.OrchDirects)
+	metric("orch_positives_total", "counter", "Pings telling there is data to read.", "", m.OrchPositives)
+	metric("write_buffer_bytes", "gauge", "Bytes waiting in write buffers.", "", m.WriteBuffered)
+	metric("dropped_frames_total", "counter", "Frames dropped because the read buffer is full.", "", m.DroppedFrames)
+	metric("resent_frames_total", "counter", "Frames sent again because they were not acknowledged in time.", "", m.ResentFrames)
+	metric("errors_total", "counter", "Connections broken by errors.", "", m.Errors)
+
+	var buckets []interface{}
+	for i, b := range toh.DialBuckets {
+		buckets = append(buckets, `_bucket{le="`+strconv.FormatFloat(b, 'f', -1, 64)+`"}`, m.DialBuckets[i])
+	}
+	buckets = append(buckets, `_bucket{le="+Inf"}`, m.DialCount, "_sum", m.DialSeconds, "_count", m.DialCount)
+	metric("dial_seconds", "histogram", "Latency of dialing toh connections.", buckets...)
+
+	if stat != nil {
+		metric("tunnel_bytes_total", "counter", "Bytes relayed by tunnels.",
+			`{direction="sent"}`, atomic.LoadInt64(stat.Sent()), `{direction="recv"}`, atomic.LoadInt64(stat.Recv()))
+	}
+}
@@ -0,0 +1,98 @@
+package goflyway
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/coyove/goflyway/toh"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	ln, err := toh.Listen("k", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	// at least one dial is observed by the histogram
+	conn, err := toh.NewDialer("k", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	stat := &Traffic{}
+	stat.Set(3, 4)
+	var buf bytes.Buffer
+	WriteMetrics(&buf, stat)
+
+	help, types := map[string]bool{}, map[string]string{}
+	samples := map[string]string{}
+	var buckets []string
+	for s := bufio.NewScanner(&buf); s.Scan(); {
+		line := s.Text()
+		if f := strings.Fields(line); f[0] == "#" {
+			if len(f) < 4 || f[1] != "HELP" && f[1] != "TYPE" {
+				t.Fatal(line)
+			}
+			if f[1] == "TYPE" {
+				if !help[f[2]] {
+					t.Fatal("no HELP before", line)
+				}
+				types[f[2]] = f[3]
+			}
+			help[f[2]] = true
+			continue
+		}
+
+		idx := strings.LastIndex(line, " ")
+		name, value := line[:idx], line[idx+1:]
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			t.Fatal(line)
+		}
+		samples[name] = value
+
+		family := name
+		if i := strings.Index(family, "{"); i > -1 {
+			family = family[:i]
+		}
+		if types[family] == "" {
+			family = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(family, "_bucket"), "_sum"), "_count")
+			if types[family] != "histogram" {
+				t.Fatal("no TYPE before", line)
+			}
+		}
+		if strings.HasPrefix(name, "goflyway_dial_seconds_bucket") {
+			buckets = append(buckets, line)
+		}
+	}
+
+	if len(buckets) != len(toh.DialBuckets)+1 || !strings.HasPrefix(buckets[len(buckets)-1], `goflyway_dial_seconds_bucket{le="+Inf"} `) {
+		t.Fatal(buckets)
+	}
+	last := int64(0)
+	for _, b := range buckets {
+		n, _ := strconv.ParseInt(b[strings.LastIndex(b, " ")+1:], 10, 64)
+		if n < last {
+			t.Fatal("buckets are not cumulative", buckets)
+		}
+		last = n
+	}
+	if count := samples["goflyway_dial_seconds_count"]; count != strconv.FormatInt(last, 10) || last < 1 {
+		t.Fatal(count, last)
+	}
+	if sum, _ := strconv.ParseFloat(samples["goflyway_dial_seconds_sum"], 64); sum <= 0 {
+		t.Fatal(sum)
+	}
+	if samples[`goflyway_tunnel_bytes_total{direction="sent"}`] != "3" || samples[`goflyway_tunnel_bytes_total{direction="recv"}`] != "4" {
+		t.Fatal(samples)
+	}
+}
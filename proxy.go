@@ -0,0 +1,209 @@
+package goflyway
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/coyove/goflyway/toh"
+)
+
+// OutboundProxy is an HTTP(S) CONNECT or SOCKS5 proxy used by the server to reach destinations
+type OutboundProxy struct {
+	URL    string   `json:"url"`    // http://[user:pass@]host:port, https://... or socks5://[user:pass@]host:port
+	Match  []string `json:"match"`  // destinations using this proxy, empty means all
+	Bypass []string `json:"bypass"` // destinations never using this proxy
+
+	u *url.URL
+}
+
+func (p *OutboundProxy) check() (err error) {
+	if p.u, err = url.Parse(p.URL); err != nil {
+		return err
+	}
+
+	switch p.u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy scheme: %q", p.u.Scheme)
+	}
+
+	if p.u.Port() == "" {
+		switch p.u.Scheme {
+		case "http":
+			p.u.Host += ":80"
+		case "https":
+			p.u.Host += ":443"
+		case "socks5":
+			p.u.Host += ":1080"
+		}
+	}
+	return nil
+}
+
+func (p *OutboundProxy) match(host string) bool {
+	if matchHosts(p.Bypass, host) {
+		return false
+	}
+	return len(p.Match) == 0 || matchHosts(p.Match, host)
+}
+
+func (p *OutboundProxy) dial(host string, timeout time.Duration) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	if p.u.Scheme == "https" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", p.u.Host, &tls.Config{ServerName: p.u.Hostname()})
+	} else {
+		conn, err = net.DialTimeout("tcp", p.u.Host, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if p.u.Scheme == "socks5" {
+		err = p.socks5Connect(conn, host)
+	} else {
+		conn, err = p.httpConnect(conn, host)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", p.u.Host, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (p *OutboundProxy) httpConnect(conn net.Conn, host string) (net.Conn, error) {
+	req := "CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n"
+	if p.u.User != nil {
+		pass, _ := p.u.User.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(p.u.User.Username()+":"+pass)) + "\r\n"
+	}
+
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return conn, err
+	}
+
+	bc := toh.NewBufConn(conn)
+	resp, err := http.ReadResponse(bc.Reader, nil)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT %s: %s", host, resp.Status)
+	}
+	return bc, nil
+}
+
+func (p *OutboundProxy) socks5Connect(conn net.Conn, host string) error {
+	buf := make([]byte, 0, 512)
+
+	if p.u.User != nil {
+		buf = append(buf, 0x05, 2, 0x00, 0x02)
+	} else {
+		buf = append(buf, 0x05, 1, 0x00)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+
+	switch buf[1] {
+	case 0x00:
+	case 0x02:
+		if p.u.User == nil {
+			return fmt.Errorf("SOCKS5 server requires auth")
+		}
+		user := p.u.User.Username()
+		pass, _ := p.u.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("SOCKS5 username or password too long")
+		}
+
+		buf = append(buf[:0], 0x01, byte(len(user)))
+		buf = append(append(buf, user...), byte(len(pass)))
+		buf = append(buf, pass...)
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return fmt.Errorf("SOCKS5 auth failed")
+		}
+	default:
+		return fmt.Errorf("SOCKS5 server doesn't support our auth methods")
+	}
+
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return err
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	buf = append(buf[:0], 0x05, 0x01, 0x00)
+	if ip := net.ParseIP(h); ip == nil {
+		if len(h) > 255 {
+			return fmt.Errorf("SOCKS5 destination too long")
+		}
+		buf = append(buf, 0x03, byte(len(h)))
+		buf = append(buf, h...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(append(buf, 0x01), ip4...)
+	} else {
+		buf = append(append(buf, 0x04), ip.To16()...)
+	}
+	buf = append(buf, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(portnum))
+
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	// reply: ver | rep | rsv | atyp | bind addr | bind port
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 connect %s: error code %d", host, buf[1])
+	}
+
+	var addrsize int
+	switch buf[3] {
+	case 0x01:
+		addrsize = net.IPv4len
+	case 0x04:
+		addrsize = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		addrsize = int(buf[0])
+	default:
+		return fmt.Errorf("SOCKS5 invalid address type: %d", buf[3])
+	}
+
+	_, err = io.ReadFull(conn, buf[:addrsize+2])
+	return err
+}
@@ -0,0 +1,123 @@
+package goflyway
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboundProxyCheck(t *testing.T) {
+	for _, c := range []struct {
+		url, host string
+		ok        bool
+	}{
+		{"http://p", "p:80", true},
+		{"https://p", "p:443", true},
+		{"socks5://u:x@p", "p:1080", true},
+		{"socks5://p:9050", "p:9050", true},
+		{"ftp://p", "", false},
+	} {
+		p := &OutboundProxy{URL: c.url}
+		if err := p.check(); (err == nil) != c.ok || c.ok && p.u.Host != c.host {
+			t.Fatal(c.url, err)
+		}
+	}
+
+	p := &OutboundProxy{Match: []string{"*.example.com"}, Bypass: []string{"a.example.com"}}
+	for host, ok := range map[string]bool{
+		"b.example.com:80": true,
+		"a.example.com:80": false,
+		"example.org:80":   false,
+	} {
+		if p.match(host) != ok {
+			t.Fatal(host)
+		}
+	}
+}
+
+// fakeProxy accepts one connection, serve does the handshake and the rest is echoed
+func fakeProxy(t *testing.T, serve func(conn net.Conn, r *bufio.Reader) bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if serve(conn, r) {
+			io.Copy(conn, r)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestOutboundProxyDial(t *testing.T) {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("u:x"))
+	httpProxy := func(status string) func(net.Conn, *bufio.Reader) bool {
+		return func(conn net.Conn, r *bufio.Reader) bool {
+			req, err := http.ReadRequest(r)
+			if err != nil || req.Method != "CONNECT" || req.Host != "dst:80" || req.Header.Get("Proxy-Authorization") != auth {
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+				return false
+			}
+			conn.Write([]byte("HTTP/1.1 " + status + "\r\n\r\n"))
+			return strings.HasPrefix(status, "200")
+		}
+	}
+	socks5Proxy := func(conn net.Conn, r *bufio.Reader) bool {
+		buf := make([]byte, 512)
+		if io.ReadFull(r, buf[:4]); string(buf[:4]) != "\x05\x02\x00\x02" {
+			return false
+		}
+		conn.Write([]byte{5, 2})
+		if io.ReadFull(r, buf[:5]); string(buf[:5]) != "\x01\x01u\x01x" {
+			return false
+		}
+		conn.Write([]byte{1, 0})
+		if io.ReadFull(r, buf[:10]); string(buf[:10]) != "\x05\x01\x00\x03\x03dst\x00\x50" {
+			return false
+		}
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		return true
+	}
+
+	for _, c := range []struct {
+		scheme string
+		serve  func(net.Conn, *bufio.Reader) bool
+		ok     bool
+	}{
+		{"http", httpProxy("200 Connection established"), true},
+		{"http", httpProxy("403 Forbidden"), false},
+		{"socks5", socks5Proxy, true},
+	} {
+		p := &OutboundProxy{URL: c.scheme + "://u:x@" + fakeProxy(t, c.serve)}
+		if err := p.check(); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := p.dial("dst:80", time.Second)
+		if (err == nil) != c.ok {
+			t.Fatal(c.scheme, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		buf := make([]byte, 5)
+		conn.Write([]byte("hello"))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatal(c.scheme, err, string(buf))
+		}
+		conn.Close()
+	}
+}
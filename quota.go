@@ -0,0 +1,129 @@
+package goflyway
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Quota limits bytes a user can relay (both directions), 0 means unlimited.
+// Days and months are in UTC
+type Quota struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+// quotaUsage counts bytes of a user in the current day and month
+type quotaUsage struct {
+	mu             sync.Mutex
+	day, month     time.Time
+	daily, monthly int64
+}
+
+func (u *quotaUsage) reset(now time.Time) {
+	now = now.UTC()
+	if d := now.Truncate(24 * time.Hour); !d.Equal(u.day) {
+		u.day, u.daily = d, 0
+	}
+	if m := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC); !m.Equal(u.month) {
+		u.month, u.monthly = m, 0
+	}
+}
+
+// quotaTable holds usages of all users, it lives as long as the server
+type quotaTable struct {
+	mu     sync.Mutex
+	usages map[string]*quotaUsage
+}
+
+// get returns the quota of user in config, nil if the user has no quota.
+// Usage of a user seen for the first time is restored from the ledger if there is one
+func (t *quotaTable) get(config *ServerConfig, user string) *quota {
+	q, ok := config.Quotas[user]
+	if !ok || (q.Daily <= 0 && q.Monthly <= 0) {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u := t.usages[user]
+	if u == nil {
+		u = &quotaUsage{}
+		u.reset(time.Now())
+		if config.Ledger != nil {
+			for _, e := range config.Ledger.Query(LedgerQuery{Unit: LedgerDay, User: user, From: u.month}) {
+				if e.User != user {
+					continue
+				}
+				if !e.Period.Before(u.day) {
+					u.daily += e.Sent + e.Recv
+				}
+				u.monthly += e.Sent + e.Recv
+			}
+		}
+		if t.usages == nil {
+			t.usages = map[string]*quotaUsage{}
+		}
+		t.usages[user] = u
+	}
+	return &quota{Quota: q, user: user, usage: u}
+}
+
+type quota struct {
+	Quota
+	user  string
+	usage *quotaUsage
+}
+
+// use adds n bytes to the usage, it returns an error if the quota is exceeded
+func (q *quota) use(n int64) error {
+	if q == nil {
+		return nil
+	}
+
+	u := q.usage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.reset(time.Now())
+	u.daily += n
+	u.monthly += n
+	return q.exceeded()
+}
+
+// check returns an error if the quota has been used up
+func (q *quota) check() error {
+	if q == nil {
+		return nil
+	}
+
+	q.usage.mu.Lock()
+	defer q.usage.mu.Unlock()
+
+	q.usage.reset(time.Now())
+	if q.Daily > 0 && q.usage.daily >= q.Daily || q.Monthly > 0 && q.usage.monthly >= q.Monthly {
+		return q.errorf()
+	}
+	return nil
+}
+
+func (q *quota) exceeded() error {
+	if q.Daily > 0 && q.usage.daily > q.Daily || q.Monthly > 0 && q.usage.monthly > q.Monthly {
+		return q.errorf()
+	}
+	return nil
+}
+
+func (q *quota) errorf() error {
+	name := "user " + q.user
+	if q.user == "" {
+		name = "the key"
+	}
+
+	u := q.usage
+	if q.Monthly > 0 && u.monthly >= q.Monthly {
+		return fmt.Errorf("monthly quota of %s is exhausted, resets at %s", name, u.month.AddDate(0, 1, 0).Format(time.RFC3339))
+	}
+	return fmt.Errorf("daily quota of %s is exhausted, resets at %s", name, u.day.Add(24*time.Hour).Format(time.RFC3339))
+}
@@ -0,0 +1,58 @@
+package goflyway
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaRollover(t *testing.T) {
+	tz := time.FixedZone("UTC+8", 8*3600)
+	u := &quotaUsage{}
+	for _, c := range []struct {
+		now            time.Time
+		daily, monthly int64
+	}{
+		{time.Date(2024, 1, 30, 10, 0, 0, 0, time.UTC), 0, 0},
+		{time.Date(2024, 1, 30, 23, 59, 59, 0, time.UTC), 10, 10},
+		{time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), 0, 20},
+		{time.Date(2024, 2, 1, 7, 59, 59, 0, tz), 10, 30},
+		{time.Date(2024, 2, 1, 8, 0, 0, 0, tz), 0, 0},
+		{time.Date(2025, 2, 1, 8, 0, 0, 0, time.UTC), 0, 0},
+	} {
+		u.reset(c.now)
+		if u.daily != c.daily || u.monthly != c.monthly {
+			t.Fatal(c.now, u.daily, u.monthly)
+		}
+		if now := c.now.UTC(); !u.day.Equal(now.Truncate(24*time.Hour)) || u.month.Month() != now.Month() || u.month.Year() != now.Year() || u.month.Day() != 1 {
+			t.Fatal(c.now, u.day, u.month)
+		}
+		u.daily += 10
+		u.monthly += 10
+	}
+}
+
+func TestQuotaUse(t *testing.T) {
+	config := &ServerConfig{Quotas: map[string]Quota{"alice": {Daily: 100, Monthly: 150}}}
+	table := &quotaTable{}
+	if table.get(config, "bob") != nil {
+		t.Fatal("bob has no quota")
+	}
+
+	q := table.get(config, "alice")
+	if err := q.use(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.check(); err == nil || !strings.Contains(err.Error(), "daily quota of user alice") {
+		t.Fatal(err)
+	}
+
+	// the next day
+	q.usage.day = q.usage.day.Add(-24 * time.Hour)
+	if err := table.get(config, "alice").check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.use(51); err == nil || !strings.Contains(err.Error(), "monthly quota") {
+		t.Fatal(err)
+	}
+}
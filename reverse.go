@@ -0,0 +1,301 @@
+package goflyway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coyove/goflyway/toh"
+	. "github.com/coyove/goflyway/v"
+)
+
+// Reverse forwarding runs two kinds of requests over toh connections:
+//
+//	"+listen addr": control connection, server listens on addr and writes the id of every
+//	                accepted connection back, client sends empty lines as heartbeats
+//	"+accept id":   data connection, server bridges it with the accepted connection
+const (
+	cmdListen = "+listen "
+	cmdAccept = "+accept "
+)
+
+type reverseTable struct {
+	pending sync.Map // id -> *reverseConn
+}
+
+// reverseConn is a connection accepted by a reverse listener, only its owner can claim it
+type reverseConn struct {
+	net.Conn
+	user string
+}
+
+func (t *reverseTable) add(conn net.Conn, user string, timeout time.Duration) (string, error) {
+	// ids are unguessable, a leaked id still can't be claimed by other users
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+	t.pending.Store(id, &reverseConn{Conn: conn, user: user})
+
+	time.AfterFunc(timeout, func() {
+		if conn := t.take(id, user); conn != nil {
+			Vprint("reverse connection ", id, " is not claimed in time")
+			conn.Close()
+		}
+	})
+	return id, nil
+}
+
+func (t *reverseTable) take(id, user string) net.Conn {
+	rc, ok := t.pending.Load(id)
+	if !ok || rc.(*reverseConn).user != user || !t.pending.CompareAndDelete(id, rc) {
+		return nil
+	}
+	return rc.(*reverseConn).Conn
+}
+
+// listenerConn lets a reverse listener be counted by the limits like a connection, only Close is used
+type listenerConn struct {
+	net.Conn
+	ln net.Listener
+}
+
+func (c *listenerConn) Close() error {
+	return c.ln.Close()
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// reverseBind checks addr requested by the client, like ssh -R, a missing host means loopback.
+// Addresses other than loopback must match ReverseBinds
+func (config *ServerConfig) reverseBind(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	addr = net.JoinHostPort(host, port)
+
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() || matchHosts(config.ReverseBinds, addr) {
+		return addr, nil
+	}
+	return "", fmt.Errorf("reverse listening on %s is not allowed", addr)
+}
+
+func (config *ServerConfig) handleListen(down *toh.BufConn, addr string, user string) {
+	addr, err := config.reverseBind(addr)
+	if err != nil {
+		Vprint("reverse listen: ", err)
+		reject(down, err.Error(), config.Timeout)
+		return
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		Vprint("reverse listen ", addr, ": ", err)
+		reject(down, err.Error(), config.Timeout)
+		return
+	}
+
+	// The listener and connections accepted by it are capped by the limits like other connections of the user
+	lc, err := config.live.ln.Admit(&listenerConn{ln: ln}, addrIP(down.RemoteAddr()), user)
+	if err != nil {
+		ln.Close()
+		Vprint("reverse listen ", addr, ": ", err)
+		reject(down, err.Error(), config.Timeout)
+		return
+	}
+	defer lc.Close()
+
+	down.Write([]byte("OK\n"))
+	Vprint("reverse listen on ", addr)
+
+	go func() {
+		// Heartbeats from the client, the listener goes down with the control connection
+		for {
+			if _, err := down.ReadBytes('\n'); err != nil {
+				Vprint("reverse listener ", addr, " closed: ", err)
+				ln.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		tc, err := config.live.ln.Admit(conn, addrIP(conn.RemoteAddr()), user)
+		if err != nil {
+			Vprint("reverse listener ", addr, " refused a connection: ", err)
+			conn.Close()
+			continue
+		}
+
+		id, err := config.reverse.add(tc, user, config.Timeout)
+		if err != nil {
+			Eprint("reverse listener ", addr, ": ", err)
+			tc.Close()
+			continue
+		}
+		if _, err := down.Write([]byte(id + "\n")); err != nil {
+			if conn := config.reverse.take(id, user); conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// handleAccept relays a connection accepted by a reverse listener, it is accounted
+// like other tunnels of the user with the peer of the connection as the destination
+func (config *ServerConfig) handleAccept(down *toh.BufConn, id string, info *ConnInfo) {
+	up := config.reverse.take(id, info.User)
+	if up == nil {
+		reject(down, "reverse connection "+id+" has gone", config.Timeout)
+		return
+	}
+	defer up.Close()
+
+	info.Remote = up.RemoteAddr().String()
+	config.live.conns.describe(down, info)
+
+	q := config.live.quotas.get(config, info.User)
+	if err := q.check(); err != nil {
+		Vprint("reverse connection ", info.Remote, " refused: ", err)
+		reject(down, err.Error(), config.Timeout)
+		return
+	}
+
+	down.Write([]byte("OK\n"))
+	upbks, downbks := config.live.shaper.buckets(&config.Shaping, info.User, config.SpeedThrot)
+	bridge(up, newCountedConn(down, info, config.Ledger), config.Stat, q, upbks, downbks)
+}
+
+// NewReverseClient asks the server to listen on remoteaddr and relays
+// connections accepted there to localaddr, like "ssh -R"
+func NewReverseClient(remoteaddr, localaddr string, config *ClientConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	return config.start().forwardReverse(Forward{Local: localaddr, Remote: remoteaddr, Reverse: true})
+}
+
+func (live *liveClient) forwardReverse(f Forward) error {
+	for {
+		if err := live.serveReverse(f.Remote, f.Local); err != nil {
+			select {
+			case <-live.done:
+				return nil
+			default:
+			}
+			Eprint("reverse forward ", f.Remote, ": ", err)
+		}
+
+		select {
+		case <-live.done:
+			return nil
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+func (live *liveClient) serveReverse(remoteaddr, localaddr string) error {
+	config, upstreams := live.load()
+	up, err := upstreams.Dial()
+	if err != nil {
+		return err
+	}
+	defer up.Close()
+
+	if !live.listeners.add(up) {
+		return nil
+	}
+	defer live.listeners.remove(up)
+
+	// Accepted connections are only known by the server we are listening on
+	server := up.(*upstreamConn).up.Addr
+
+	ctrl, err := handshake(up, cmdListen+remoteaddr)
+	if err != nil {
+		return err
+	}
+
+	Vprint("reverse: forward server's ", remoteaddr, " to ", localaddr)
+
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(config.Timeout / 3):
+				if _, err := ctrl.Write([]byte("\n")); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		line, err := ctrl.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+
+		if id := string(bytes.TrimSpace(line)); id != "" {
+			go live.acceptReverse(server, id, localaddr)
+		}
+	}
+}
+
+func (live *liveClient) acceptReverse(server, id, localaddr string) {
+	config, upstreams := live.load()
+	up, err := upstreams.DialAddr(server)
+	if err != nil {
+		Eprint("dial server: ", err)
+		return
+	}
+	defer up.Close()
+
+	upconn, err := handshake(up, cmdAccept+id)
+	if err != nil {
+		Eprint(err)
+		return
+	}
+
+	down, err := net.DialTimeout("tcp", localaddr, config.Timeout)
+	if err != nil {
+		Eprint("reverse dial ", localaddr, ": ", err)
+		return
+	}
+	defer down.Close()
+
+	if !live.conns.add(down) {
+		return
+	}
+	defer live.conns.remove(down)
+
+	info := &ConnInfo{Local: server, Remote: localaddr, Start: time.Now()}
+	live.conns.describe(down, info)
+
+	upbks, downbks := live.shaper.buckets(&config.Shaping, "")
+	bridge(down, newCountedConn(upconn, info, config.Ledger), config.Stat, nil, upbks, downbks)
+}
@@ -0,0 +1,76 @@
+package goflyway
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coyove/goflyway/toh"
+)
+
+func TestReverseBind(t *testing.T) {
+	config := &ServerConfig{ReverseBinds: []string{"0.0.0.0:8080", "10.0.0.0/8"}}
+	for _, c := range []struct {
+		addr, bind string
+	}{
+		{":8080", "127.0.0.1:8080"},
+		{"localhost:22", "localhost:22"},
+		{"[::1]:22", "[::1]:22"},
+		{"0.0.0.0:8080", "0.0.0.0:8080"},
+		{"0.0.0.0:8081", ""},
+		{"10.1.2.3:22", "10.1.2.3:22"},
+		{"192.168.1.1:22", ""},
+		{"8080", ""},
+	} {
+		bind, err := config.reverseBind(c.addr)
+		if bind != c.bind || (err == nil) != (c.bind != "") {
+			t.Fatal(c.addr, bind, err)
+		}
+	}
+}
+
+func TestReverseTable(t *testing.T) {
+	var tab reverseTable
+	a, b := net.Pipe()
+	defer b.Close()
+
+	id, _ := tab.add(a, "alice", 50*time.Millisecond)
+	if tab.take(id, "bob") != nil || tab.take(id, "alice") != a || tab.take(id, "alice") != nil {
+		t.Fatal("taken twice or by others")
+	}
+
+	// Not claimed in time, the conn is closed
+	id2, _ := tab.add(a, "alice", 10*time.Millisecond)
+	if len(id2) != 32 || id2 == id {
+		t.Fatal(id, id2)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if tab.take(id2, "alice") != nil {
+		t.Fatal("expired conn is taken")
+	}
+	if _, err := a.Write([]byte{1}); err == nil {
+		t.Fatal("expired conn is not closed")
+	}
+}
+
+func TestReverseAcceptUser(t *testing.T) {
+	config := &ServerConfig{reverse: &reverseTable{}}
+	a, b := net.Pipe()
+	defer b.Close()
+	id, err := config.reverse.add(a, "alice", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bob knows the id but can't claim alice's connection
+	c, d := net.Pipe()
+	defer d.Close()
+	go config.handleAccept(toh.NewBufConn(c), id, &ConnInfo{User: "bob"})
+	if line, _ := bufio.NewReader(d).ReadString('\n'); line != "reverse connection "+id+" has gone\n" {
+		t.Fatal(line)
+	}
+	if config.reverse.take(id, "alice") != a {
+		t.Fatal("alice's connection is gone")
+	}
+}
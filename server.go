@@ -2,11 +2,14 @@ package goflyway
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/coyove/goflyway/toh"
@@ -14,10 +17,13 @@ import (
 )
 
 type commonConfig struct {
-	WriteBuffer int64
-	Key         string
-	Timeout     time.Duration
-	Stat        *Traffic
+	WriteBuffer  int64
+	Key          string
+	Timeout      time.Duration
+	DrainTimeout time.Duration // how long to wait for active tunnels when shutting down
+	Stat         *Traffic
+	Ledger       *Ledger // accounts traffic by user and destination if not nil
+	Shaping      Shaping
 }
 
 func (config *commonConfig) check() {
@@ -27,24 +33,109 @@ func (config *commonConfig) check() {
 	if config.WriteBuffer == 0 {
 		config.WriteBuffer = 1024 * 1024 // 1M
 	}
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = time.Second * 30
+	}
 }
 
 type ServerConfig struct {
 	commonConfig
 	ProxyPassAddr string
+	Users         map[string]string // user -> key, connections using these keys are named after their users
+	Quotas        map[string]Quota  // user -> quota, "" for connections using Key
+	Limits        toh.Limits
 	SpeedThrot    *TokenBucket
+	Hops          []Hop
+	Proxies       []OutboundProxy
+	ACL           ACL
+
+	// IPs or CIDRs of proxies in front of the server, X-Forwarded-For from them is honoured
+	TrustedProxies []string
+
+	// Addresses clients can listen on for reverse forwarding besides loopback, see matchHost
+	ReverseBinds []string
+
+	hopDialers []*toh.Dialer
+	reverse    *reverseTable
+	live       *liveServer
 }
 
-func NewServer(listen string, config *ServerConfig) error {
+// Hop forwards destinations matching any pattern in Match through another goflyway server
+type Hop struct {
+	Match     []string `json:"match"`
+	Upstream  string   `json:"upstream"`
+	Key       string   `json:"key"`
+	WebSocket bool     `json:"websocket"`
+}
+
+// ACL decides which destinations the server is allowed to connect to,
+// Deny takes precedence, empty Allow means everything not denied is allowed
+type ACL struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+func (acl *ACL) permits(host string) bool {
+	if matchHosts(acl.Deny, host) {
+		return false
+	}
+	return len(acl.Allow) == 0 || matchHosts(acl.Allow, host)
+}
+
+func (config *ServerConfig) dial(host string) (net.Conn, error) {
+	for i, hop := range config.Hops {
+		if !matchHosts(hop.Match, host) {
+			continue
+		}
+
+		up, err := config.hopDialers[i].Dial()
+		if err != nil {
+			return nil, fmt.Errorf("dial hop %s: %v", hop.Upstream, err)
+		}
+
+		conn, err := handshake(up, host)
+		if err != nil {
+			up.Close()
+			return nil, fmt.Errorf("hop %s: %v", hop.Upstream, err)
+		}
+		return conn, nil
+	}
+
+	for i := range config.Proxies {
+		if p := &config.Proxies[i]; p.match(host) {
+			return p.dial(host, config.Timeout)
+		}
+	}
+
+	return net.DialTimeout("tcp", host, config.Timeout)
+}
+
+// prepare checks the config and builds the listener options and hop dialers
+func (config *ServerConfig) prepare() ([]toh.Option, error) {
 	config.check()
 
-	rp := append([]toh.Option{}, toh.WithMaxWriteBuffer(int(config.WriteBuffer)))
+	proxies, err := parseNets(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := []toh.Option{
+		toh.WithMaxWriteBuffer(int(config.WriteBuffer)),
+		toh.WithInactiveTimeout(config.Timeout),
+		toh.WithBadRequest(nil),
+		toh.WithLimits(config.Limits),
+		toh.WithTrustedProxies(proxies),
+	}
+
+	if err := config.Limits.Validate(); err != nil {
+		return nil, fmt.Errorf("limits: %v", err)
+	}
 
 	if config.ProxyPassAddr != "" {
 		if strings.HasPrefix(config.ProxyPassAddr, "http") {
 			u, err := url.Parse(config.ProxyPassAddr)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			rp = append(rp, toh.WithBadRequest(httputil.NewSingleHostReverseProxy(u).ServeHTTP))
 		} else {
@@ -52,42 +143,203 @@ func NewServer(listen string, config *ServerConfig) error {
 		}
 	}
 
-	listener, err := toh.Listen(config.Key, listen, rp...)
+	keys := map[string]string{config.Key: ""}
+	for user, key := range config.Users {
+		if user == "" || key == "" {
+			return nil, fmt.Errorf("user and key must not be empty")
+		}
+		if u, ok := keys[key]; ok {
+			return nil, fmt.Errorf("user %q shares the same key with %q", user, u)
+		}
+		keys[key] = user
+	}
+
+	if err := config.Shaping.check(); err != nil {
+		return nil, err
+	}
+
+	for user, q := range config.Quotas {
+		if q.Daily < 0 || q.Monthly < 0 {
+			return nil, fmt.Errorf("quota of user %q must not be negative", user)
+		}
+	}
+
+	for i := range config.Proxies {
+		if err := config.Proxies[i].check(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, acl := range [][]string{config.ACL.Allow, config.ACL.Deny, config.ReverseBinds} {
+		for _, p := range acl {
+			if strings.Contains(p, "/") {
+				if _, _, err := net.ParseCIDR(p); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	config.hopDialers = config.hopDialers[:0]
+	for _, hop := range config.Hops {
+		key := hop.Key
+		if key == "" {
+			key = config.Key
+		}
+		config.hopDialers = append(config.hopDialers, toh.NewDialer(key, hop.Upstream,
+			toh.WithWebSocket(hop.WebSocket),
+			toh.WithInactiveTimeout(config.Timeout),
+			toh.WithMaxWriteBuffer(int(config.WriteBuffer))))
+	}
+	return rp, nil
+}
+
+// closeHops closes dialers of hops, tunnels through them are not affected
+func (config *ServerConfig) closeHops() {
+	for _, d := range config.hopDialers {
+		d.Close()
+	}
+}
+
+// liveServer is shared by all configs which have been applied to a running server
+type liveServer struct {
+	ln     *toh.Listener
+	config atomic.Value // *ServerConfig
+	conns  closerSet
+	quotas quotaTable
+	shaper shaper
+}
+
+func (l *liveServer) current() *ServerConfig {
+	return l.config.Load().(*ServerConfig)
+}
+
+func NewServer(listen string, config *ServerConfig) error {
+	return NewServerContext(context.Background(), listen, config)
+}
+
+// NewServerContext serves until ctx is done, then it stops accepting new connections,
+// waits config.DrainTimeout for active tunnels to finish and closes the rest.
+// It returns nil if all tunnels finished in time
+func NewServerContext(ctx context.Context, listen string, config *ServerConfig) error {
+	s := NewServerHandle(listen, config)
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	select {
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+	}
+
+	dctx, cancel := context.WithTimeout(context.Background(), config.live.current().DrainTimeout)
+	defer cancel()
+	return s.Shutdown(dctx)
+}
+
+// Reload applies newConfig to the server started by NewServer, new connections will use
+// the new settings while existing ones keep running with the old ones.
+// The listening address can't be changed, the running server is not affected if newConfig is invalid
+func (config *ServerConfig) Reload(newConfig *ServerConfig) error {
+	if config.live == nil {
+		return fmt.Errorf("server is not running")
+	}
+
+	rp, err := newConfig.prepare()
 	if err != nil {
 		return err
 	}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			return err
+	old := config.live.current()
+	newConfig.reverse = old.reverse
+	if newConfig.Stat == nil {
+		newConfig.Stat = old.Stat
+	}
+	if newConfig.Ledger == nil {
+		newConfig.Ledger = old.Ledger
+	}
+	newConfig.live = config.live
+
+	config.live.ln.SetKey(newConfig.Key)
+	config.live.ln.SetUsers(newConfig.Users)
+	config.live.ln.SetOptions(rp...)
+	config.live.config.Store(newConfig)
+	old.closeHops()
+	return nil
+}
+
+// reject sends msg to the client and waits at most timeout for it to be fetched,
+// because data not fetched by the client are dropped when the connection closes
+func reject(down *toh.BufConn, msg string, timeout time.Duration) {
+	down.Write([]byte(msg + "\n"))
+
+	if b, ok := down.Conn.(interface{ Buffered() int }); ok {
+		for start := time.Now(); b.Buffered() > 0 && time.Since(start) < timeout; {
+			time.Sleep(50 * time.Millisecond)
 		}
+	}
+}
 
-		go func(conn net.Conn) {
-			down := toh.NewBufConn(conn)
-			defer down.Close()
+func (config *ServerConfig) serve(conn net.Conn) {
+	down := toh.NewBufConn(conn)
+	defer down.Close()
 
-			buf, err := down.ReadBytes('\n')
-			if err != nil || len(buf) < 2 {
-				Vprint(err)
-				return
-			}
+	config.live.conns.add(down)
+	defer config.live.conns.remove(down)
 
-			host := string(bytes.TrimRight(buf, "\n"))
+	buf, err := down.ReadBytes('\n')
+	if err != nil || len(buf) < 2 {
+		Vprint(err)
+		return
+	}
 
-			dialstart := time.Now()
-			up, err := net.DialTimeout("tcp", host, config.Timeout)
-			if err != nil {
-				Vprint(host, err)
-				down.Write([]byte(err.Error() + "\n"))
-				return
-			}
+	host := string(bytes.TrimRight(buf, "\n"))
 
-			Vprint("dial ", host, " in ", time.Since(dialstart).Nanoseconds()/1e6, "ms")
-			defer up.Close()
+	info := &ConnInfo{Local: conn.RemoteAddr().String(), Remote: host, Start: time.Now(), conn: conn}
+	if c, ok := conn.(interface{ ID() string }); ok {
+		info.Conn = c.ID()
+	}
+	if c, ok := conn.(interface{ User() string }); ok {
+		info.User = c.User()
+	}
+
+	switch {
+	case strings.HasPrefix(host, cmdListen):
+		config.live.conns.describe(down, info)
+		config.handleListen(down, strings.TrimPrefix(host, cmdListen), info.User)
+		return
+	case strings.HasPrefix(host, cmdAccept):
+		config.handleAccept(down, strings.TrimPrefix(host, cmdAccept), info)
+		return
+	}
+	config.live.conns.describe(down, info)
+
+	q := config.live.quotas.get(config, info.User)
+	if err := q.check(); err != nil {
+		Vprint(host, " refused: ", err)
+		reject(down, err.Error(), config.Timeout)
+		return
+	}
 
-			down.Write([]byte("OK\n"))
-			Bridge(up, down, config.SpeedThrot, config.Stat)
-		}(conn)
+	if !config.ACL.permits(host) {
+		Vprint(host, " is denied by ACL")
+		reject(down, "destination denied by ACL", config.Timeout)
+		return
 	}
+
+	dialstart := time.Now()
+	up, err := config.dial(host)
+	if err != nil {
+		Vprint(host, err)
+		reject(down, err.Error(), config.Timeout)
+		return
+	}
+
+	Vprint("dial ", host, " in ", time.Since(dialstart).Nanoseconds()/1e6, "ms")
+	defer up.Close()
+
+	down.Write([]byte("OK\n"))
+	upbks, downbks := config.live.shaper.buckets(&config.Shaping, info.User, config.SpeedThrot)
+	bridge(up, newCountedConn(down, info, config.Ledger), config.Stat, q, upbks, downbks)
 }
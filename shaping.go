@@ -0,0 +1,89 @@
+package goflyway
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Rate is bandwidth in bytes per second of both directions, 0 means unlimited.
+// Upload goes from the side which started the tunnel to the destination
+type Rate struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// Shaping limits bandwidth of tunnels hierarchically, a tunnel is limited by its own rate,
+// the rate shared by all tunnels of its user and the rate shared by all tunnels
+type Shaping struct {
+	Global Rate            `json:"global"`
+	User   Rate            `json:"user"`  // rate of each user, "" for connections using Key
+	Users  map[string]Rate `json:"users"` // overrides User
+	Conn   Rate            `json:"conn"`
+}
+
+func (s *Shaping) check() error {
+	rates := map[string]Rate{"global": s.Global, "user": s.User, "conn": s.Conn}
+	for user, r := range s.Users {
+		rates["users."+user] = r
+	}
+	for name, r := range rates {
+		if r.Upload < 0 || r.Download < 0 {
+			return fmt.Errorf("rate of %s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// shaper holds buckets shared by tunnels, it lives as long as the client or server
+type shaper struct {
+	mu     sync.Mutex
+	global [2]*TokenBucket
+	users  map[string][2]*TokenBucket
+}
+
+func rateBuckets(old [2]*TokenBucket, r Rate) [2]*TokenBucket {
+	for i, speed := range []int64{r.Upload, r.Download} {
+		switch {
+		case speed <= 0:
+			old[i] = nil
+		case old[i] == nil || old[i].Speed != speed:
+			old[i] = NewTokenBucket(speed, speed)
+		}
+	}
+	return old
+}
+
+// buckets returns buckets of a new tunnel of user, from the innermost to the outermost,
+// extra buckets are appended to both directions
+func (s *shaper) buckets(config *Shaping, user string, extra ...*TokenBucket) (up, down []*TokenBucket) {
+	r, ok := config.Users[user]
+	if !ok {
+		r = config.User
+	}
+
+	s.mu.Lock()
+	if s.users == nil {
+		s.users = map[string][2]*TokenBucket{}
+	}
+	ub := rateBuckets(s.users[user], r)
+	s.users[user] = ub
+	s.global = rateBuckets(s.global, config.Global)
+	gb := s.global
+	s.mu.Unlock()
+
+	cb := rateBuckets([2]*TokenBucket{}, config.Conn)
+	for _, b := range [][2]*TokenBucket{cb, ub, gb} {
+		if b[0] != nil {
+			up = append(up, b[0])
+		}
+		if b[1] != nil {
+			down = append(down, b[1])
+		}
+	}
+	for _, b := range extra {
+		if b != nil {
+			up, down = append(up, b), append(down, b)
+		}
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package goflyway
+
+import "testing"
+
+func TestShapingCheck(t *testing.T) {
+	for _, c := range []struct {
+		s  Shaping
+		ok bool
+	}{
+		{Shaping{}, true},
+		{Shaping{Global: Rate{Upload: 1}, Users: map[string]Rate{"a": {Download: 1}}}, true},
+		{Shaping{Conn: Rate{Upload: -1}}, false},
+		{Shaping{Users: map[string]Rate{"a": {Download: -1}}}, false},
+	} {
+		if err := c.s.check(); (err == nil) != c.ok {
+			t.Fatal(c.s, err)
+		}
+	}
+}
+
+func TestShapingBuckets(t *testing.T) {
+	speeds := func(bks []*TokenBucket) (res []int64) {
+		for _, b := range bks {
+			res = append(res, b.Speed)
+		}
+		return
+	}
+	equal := func(a, b []int64) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	s := &shaper{}
+	config := &Shaping{
+		Global: Rate{Upload: 1000, Download: 2000},
+		User:   Rate{Upload: 100},
+		Users:  map[string]Rate{"vip": {Download: 500}},
+		Conn:   Rate{Upload: 10, Download: 20},
+	}
+	extra := NewTokenBucket(5, 5)
+	for _, c := range []struct {
+		user     string
+		extra    *TokenBucket
+		up, down []int64
+	}{
+		{"", nil, []int64{10, 100, 1000}, []int64{20, 2000}},
+		{"alice", extra, []int64{10, 100, 1000, 5}, []int64{20, 2000, 5}},
+		{"vip", nil, []int64{10, 1000}, []int64{20, 500, 2000}},
+	} {
+		up, down := s.buckets(config, c.user, c.extra)
+		if !equal(speeds(up), c.up) || !equal(speeds(down), c.down) {
+			t.Fatal(c.user, speeds(up), speeds(down))
+		}
+	}
+
+	// buckets of the user and global ones are shared, conn ones are not
+	up1, _ := s.buckets(config, "alice")
+	up2, down2 := s.buckets(config, "alice")
+	if up1[0] == up2[0] || up1[1] != up2[1] || up1[2] != up2[2] {
+		t.Fatal("buckets are not shared properly")
+	}
+
+	// a reloaded config replaces buckets whose rates have changed and drops unlimited ones
+	config.User, config.Global.Download = Rate{Upload: 100, Download: 300}, 0
+	up3, down3 := s.buckets(config, "alice")
+	if up3[1] != up2[1] || up3[2] != up2[2] || !equal(speeds(down3), []int64{20, 300}) || down3[1] == down2[1] {
+		t.Fatal(speeds(up3), speeds(down3))
+	}
+}
@@ -0,0 +1,331 @@
+package toh
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// budget limits bytes in write buffers of all connections
+type budget struct {
+	mu    sync.Mutex
+	limit int64 // 0 means unlimited
+	used  int64
+	freed chan struct{}
+}
+
+var writeBudget = &budget{freed: make(chan struct{})}
+
+// SetWriteBudget limits bytes in write buffers of all connections in the process, 0 means unlimited.
+// When it is used up, writers of all connections wait until some buffers are flushed
+func SetWriteBudget(limit int64) {
+	b := writeBudget
+	b.mu.Lock()
+	b.limit = limit
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+func (b *budget) take(n int) {
+	atomic.AddInt64(&counters.WriteBuffered, int64(n))
+	b.mu.Lock()
+	b.used += int64(n)
+	b.mu.Unlock()
+}
+
+func (b *budget) release(n int) {
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&counters.WriteBuffered, -int64(n))
+	b.mu.Lock()
+	b.used -= int64(n)
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// full reports whether the budget is used up, the returned channel is closed when some bytes are released
+func (b *budget) full() (bool, chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit > 0 && b.used >= b.limit, b.freed
+}
+
+// writeBuf is the write buffer of ClientConn and ServerConn, writers wait when it is full
+type writeBuf struct {
+	sync.Mutex
+	buf     []byte
+	budget  *budget
+	counter uint32 // idx of the last frame
+	shut    bool   // CloseWrite is called, the next frame carries optFIN
+	finSent bool
+	closing int32 // Close is called, the connection is closed once data and FIN are delivered
+
+	unacked     []*frame // sent frames waiting for the ack, in the order of idx
+	unackedSize int
+	acked       uint32 // idx of the latest acknowledged frame, set atomically by ack before taking the lock
+	srtt        time.Duration
+	rttvar      time.Duration
+	rto         time.Duration // timeout of new frames, it stays backed off until the next sample of srtt
+
+	sig      sync.Mutex    // protects drained and deadline, so they are accessible while sending
+	drained  chan struct{} // closed and renewed when buf is flushed or frames are acknowledged
+	deadline time.Time
+}
+
+func (w *writeBuf) init() {
+	w.drained = make(chan struct{})
+	w.rto = initialRTO
+	w.budget = writeBudget
+}
+
+// pending reports whether there are data, FIN or frames not acknowledged yet, w must be locked
+func (w *writeBuf) pending() bool {
+	n := len(w.unacked)
+	return len(w.buf) > 0 || w.shut && !w.finSent || n > 0 && w.unacked[n-1].idx > atomic.LoadUint32(&w.acked)
+}
+
+// hasPending is pending for callers not holding the lock
+func (w *writeBuf) hasPending() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.pending()
+}
+
+// next takes buffered data and FIN as a new frame, which is kept until acknowledged.
+// It returns nil if there is nothing to send, w must be locked
+func (w *writeBuf) next(connIdx uint64) *frame {
+	if len(w.buf) == 0 && (!w.shut || w.finSent) {
+		return nil
+	}
+
+	w.counter++
+	f := &frame{idx: w.counter, connIdx: connIdx, data: append([]byte{}, w.buf...), sent: time.Now(), rto: w.rto}
+	if w.shut {
+		f.options = optFIN
+		w.finSent = true
+	}
+	// Bytes of the frame are still charged to the budget until it is acknowledged
+	w.unacked = append(w.unacked, f)
+	w.unackedSize += len(f.data)
+	w.buf = w.buf[:0]
+	return f
+}
+
+// due returns frames not acknowledged in their timeouts, w must be locked
+func (w *writeBuf) due() (frames []*frame) {
+	w.dropAcked()
+	for _, f := range w.unacked {
+		if f.sent.IsZero() {
+			// The last attempt failed before reaching the other side
+			f.sent = time.Now()
+			frames = append(frames, f)
+		} else if time.Since(f.sent) > f.rto {
+			f.sent, f.resent = time.Now(), true
+			if f.rto *= 2; f.rto > maxRTO {
+				f.rto = maxRTO
+			}
+			if f.rto > w.rto {
+				w.rto = f.rto
+			}
+			frames = append(frames, f)
+		}
+	}
+	atomic.AddInt64(&counters.ResentFrames, int64(len(frames)))
+	return
+}
+
+// ack records that the other side has received frames up to idx and releases them,
+// the sender never holds the lock while waiting for responses
+func (w *writeBuf) ack(idx uint32) {
+	for {
+		old := atomic.LoadUint32(&w.acked)
+		if idx <= old {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&w.acked, old, idx) {
+			break
+		}
+	}
+	w.Lock()
+	w.dropAcked()
+	w.Unlock()
+	w.wake()
+}
+
+// dropAcked drops acknowledged frames, w must be locked
+func (w *writeBuf) dropAcked() {
+	acked, i, n := atomic.LoadUint32(&w.acked), 0, 0
+	for ; i < len(w.unacked) && w.unacked[i].idx <= acked; i++ {
+		n += len(w.unacked[i].data)
+	}
+	if i > 0 {
+		// Only frames sent once are sampled, acks of resent ones are ambiguous
+		if f := w.unacked[i-1]; !f.resent && !f.sent.IsZero() {
+			w.sampleRTT(time.Since(f.sent))
+		}
+	}
+	w.unacked = w.unacked[i:]
+	w.unackedSize -= n
+	w.budget.release(n)
+}
+
+// sampleRTT updates the smoothed round trip time like RFC 6298, w must be locked
+func (w *writeBuf) sampleRTT(r time.Duration) {
+	if w.srtt == 0 {
+		w.srtt, w.rttvar = r, r/2
+	} else {
+		d := w.srtt - r
+		if d < 0 {
+			d = -d
+		}
+		w.rttvar = (3*w.rttvar + d) / 4
+		w.srtt = (7*w.srtt + r) / 8
+	}
+	if w.rto = w.srtt + 4*w.rttvar; w.rto < minRTO {
+		w.rto = minRTO
+	} else if w.rto > maxRTO {
+		w.rto = maxRTO
+	}
+}
+
+// unsent marks frames as not sent, so they will be resent as soon as possible
+func (w *writeBuf) unsent(frames []*frame) {
+	w.Lock()
+	defer w.Unlock()
+	for _, f := range frames {
+		f.sent = time.Time{}
+	}
+}
+
+// append adds p to the buffer, w must be locked
+func (w *writeBuf) append(p []byte) {
+	w.buf = append(w.buf, p...)
+	w.budget.take(len(p))
+}
+
+// reset drops buffered data and unacknowledged frames of a closed connection
+// and wakes up waiting writers, w must be locked
+func (w *writeBuf) reset() {
+	w.budget.release(len(w.buf) + w.unackedSize)
+	w.buf = w.buf[:0]
+	w.unacked, w.unackedSize = nil, 0
+	w.wake()
+}
+
+func (w *writeBuf) wake() {
+	w.sig.Lock()
+	close(w.drained)
+	w.drained = make(chan struct{})
+	w.sig.Unlock()
+}
+
+func (w *writeBuf) setDeadline(t time.Time) {
+	w.sig.Lock()
+	w.deadline = t
+	w.sig.Unlock()
+	w.wake()
+}
+
+// sendDeadline returns the write deadline if it is before t, which is the default deadline of sending
+func (w *writeBuf) sendDeadline(t time.Time) (time.Time, bool) {
+	w.sig.Lock()
+	defer w.sig.Unlock()
+	if !w.deadline.IsZero() && w.deadline.Before(t) {
+		return w.deadline, true
+	}
+	return t, false
+}
+
+// close marks w as closed by the user, first is false if it has been marked already,
+// linger reports whether data and FIN should be delivered before the connection is closed
+func (w *writeBuf) close() (first, linger bool) {
+	if !atomic.CompareAndSwapInt32(&w.closing, 0, 1) {
+		return false, false
+	}
+	w.Lock()
+	defer w.Unlock()
+	return true, w.shut && w.pending()
+}
+
+func (w *writeBuf) closed() bool {
+	return atomic.LoadInt32(&w.closing) == 1
+}
+
+// drain waits at most timeout for buffered data and FIN to be sent if CloseWrite has been called
+func (w *writeBuf) drain(timeout time.Duration, closed func() error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		w.Lock()
+		pending := w.shut && w.pending()
+		w.Unlock()
+
+		if !pending || closed() != nil {
+			return
+		}
+
+		w.sig.Lock()
+		drained := w.drained
+		w.sig.Unlock()
+
+		select {
+		case <-drained:
+		case <-t.C:
+			return
+		}
+	}
+}
+
+// wait blocks until the buffer is not larger than max and the budget is not used up,
+// it returns the error of closed() if the connection is closed, or timeoutError if the deadline is exceeded
+func (w *writeBuf) wait(max int, closed func() error) error {
+	for {
+		if err := closed(); err != nil {
+			return err
+		}
+
+		w.sig.Lock()
+		drained, deadline := w.drained, w.deadline
+		w.sig.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return &timeoutError{}
+		}
+
+		w.Lock()
+		w.dropAcked()
+		full := len(w.buf)+w.unackedSize > max
+		w.Unlock()
+
+		bfull, freed := w.budget.full()
+		if !full && !bfull {
+			return nil
+		}
+
+		if !bfull {
+			freed = nil
+		}
+
+		var t *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			t = time.NewTimer(time.Until(deadline))
+			timeout = t.C
+		}
+
+		// drained is also closed when the connection is closed or the deadline changes
+		select {
+		case <-drained:
+		case <-freed:
+		case <-timeout:
+			return &timeoutError{}
+		}
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package toh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriteBuf(t *testing.T) {
+	w := &writeBuf{}
+	w.init()
+	w.budget = &budget{freed: make(chan struct{})}
+	open := func() error { return nil }
+
+	w.Lock()
+	w.append([]byte("abc"))
+	f1 := w.next(1)
+	w.append([]byte("de"))
+	f2 := w.next(1)
+	w.shut = true
+	fin := w.next(1)
+	if w.next(1) != nil || f1.idx != 1 || f2.idx != 2 || fin.options != optFIN || len(w.buf) != 0 {
+		t.Fatal(f1, f2, fin)
+	}
+	w.Unlock()
+
+	// sent frames are charged to the budget until acknowledged
+	if w.budget.used != 5 || w.unackedSize != 5 || !w.pending() {
+		t.Fatal(w.budget.used, w.unackedSize)
+	}
+
+	w.Lock()
+	f1.sent = time.Now().Add(-2 * initialRTO)
+	if due := w.due(); len(due) != 1 || due[0] != f1 || !f1.resent || f1.rto != 2*initialRTO || time.Since(f1.sent) > initialRTO {
+		t.Fatal(due)
+	}
+	if due := w.due(); len(due) != 0 {
+		t.Fatal(due)
+	}
+	// the timeout is doubled for every resend
+	f1.sent = time.Now().Add(-3 * initialRTO / 2)
+	if due := w.due(); len(due) != 0 {
+		t.Fatal(due)
+	}
+	w.Unlock()
+
+	// the ack of a resent frame is not sampled
+	w.ack(1)
+	w.ack(0)
+	if w.srtt != 0 || w.rto != 2*initialRTO {
+		t.Fatal(w.srtt, w.rto)
+	}
+	if w.budget.used != 2 || len(w.unacked) != 2 || w.unacked[0] != f2 {
+		t.Fatal(w.budget.used, w.unacked)
+	}
+
+	// the buffer is full until f2 is acknowledged
+	w.setDeadline(time.Now().Add(-time.Second))
+	if err := w.wait(1, open); err == nil || !err.(*timeoutError).Timeout() {
+		t.Fatal(err)
+	}
+	w.setDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := w.wait(1, open); err == nil {
+		t.Fatal("wait should time out")
+	}
+	w.setDeadline(time.Time{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		w.ack(2)
+	}()
+	if err := w.wait(1, open); err != nil || w.budget.used != 0 {
+		t.Fatal(err, w.budget.used)
+	}
+	// f2 is sampled and replaces the backed off timeout
+	if w.srtt == 0 || w.rto != w.srtt+4*w.rttvar {
+		t.Fatal(w.srtt, w.rttvar, w.rto)
+	}
+	if !w.pending() {
+		t.Fatal("FIN is not acknowledged yet")
+	}
+	w.ack(3)
+	if w.pending() {
+		t.Fatal("nothing should be pending")
+	}
+
+	// a closed connection releases everything
+	w.Lock()
+	w.finSent, w.shut = false, false
+	w.append([]byte("fgh"))
+	w.next(1)
+	w.append([]byte("ij"))
+	w.reset()
+	w.Unlock()
+	if w.budget.used != 0 || w.unackedSize != 0 || len(w.unacked) != 0 || len(w.buf) != 0 {
+		t.Fatal(w.budget.used, w.unacked)
+	}
+}
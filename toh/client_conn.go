@@ -1,15 +1,12 @@
 package toh
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
-	"strconv"
-	"strings"
+	"net/http/httptrace"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,36 +20,33 @@ type ClientConn struct {
 	dialer *Dialer
 
 	write struct {
-		sync.Mutex
-		counter uint32
-		sched   sched.SchedKey
-		buf     []byte
-		survey  struct {
-			lastIsPositive bool
+		writeBuf
+		sched  sched.SchedKey
+		survey struct {
+			lastIsPositive int32 // 1 if the server told there was data to read, accessed atomically
 			pendingSize    int
 			reschedCount   int64
 		}
 		respCh     chan io.ReadCloser
 		respChOnce sync.Once
+		window     chan struct{} // limits concurrent uploads
 	}
 
-	read *readConn
-}
-
-func (d *Dialer) Dial() (net.Conn, error) {
-	if d.WebSocket {
-		return d.wsHandshake()
-	}
-	return d.newClientConn()
+	read  *readConn
+	addrs atomic.Value // [2]net.Addr, local and remote addresses of the latest request
 }
 
 func (d *Dialer) newClientConn() (net.Conn, error) {
+	d.orchOnce.Do(d.startOrch)
 
 	c := &ClientConn{dialer: d}
 	c.idx = newConnectionIdx()
 	c.write.survey.pendingSize = 1
 	c.write.respCh = make(chan io.ReadCloser, 128)
+	c.write.window = make(chan struct{}, d.UploadWindow)
+	c.write.init()
 	c.read = newReadConn(c.idx, d.blk, 'c')
+	c.read.onAck = c.write.ack
 
 	// Say hello
 	resp, err := c.send(frame{
@@ -64,6 +58,7 @@ func (d *Dialer) newClientConn() (net.Conn, error) {
 			options: optHello,
 		}})
 	if err != nil {
+		c.read.close()
 		return nil, err
 	}
 	resp.Body.Close()
@@ -76,6 +71,7 @@ func (d *Dialer) newClientConn() (net.Conn, error) {
 
 func (c *ClientConn) SetDeadline(t time.Time) error {
 	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
 	return nil
 }
 
@@ -85,60 +81,105 @@ func (c *ClientConn) SetReadDeadline(t time.Time) error {
 }
 
 func (c *ClientConn) SetWriteDeadline(t time.Time) error {
+	c.write.setDeadline(t)
 	return nil
 }
 
+// LocalAddr and RemoteAddr return addresses of the HTTP connection which carried the latest request,
+// the remote one is the endpoint or the proxy in between
 func (c *ClientConn) LocalAddr() net.Addr {
+	if a, ok := c.addrs.Load().([2]net.Addr); ok {
+		return a[0]
+	}
 	return &net.TCPAddr{}
 }
 
 func (c *ClientConn) RemoteAddr() net.Addr {
+	if a, ok := c.addrs.Load().([2]net.Addr); ok {
+		return a[1]
+	}
 	return &net.TCPAddr{}
 }
 
+func (c *ClientConn) gotConn(info httptrace.GotConnInfo) {
+	c.addrs.Store([2]net.Addr{info.Conn.LocalAddr(), info.Conn.RemoteAddr()})
+}
+
+// Close closes the connection without blocking, like TCP, data and FIN are still delivered
+// in background if CloseWrite has been called
 func (c *ClientConn) Close() error {
-	if c.read.closed {
+	first, linger := c.write.close()
+	if !first {
+		return nil
+	}
+	if !linger {
+		return c.close()
+	}
+	go func() {
+		c.write.drain(c.dialer.Timeout, c.writeErr)
+		c.close()
+	}()
+	return nil
+}
+
+func (c *ClientConn) close() error {
+	if c.read.isClosed() {
 		return nil
 	}
 
+	// sendWriteBuf may hold the lock for a while
+	go c.dropWriteBuf()
+
 	v.VVprint(c, " closing")
 	c.write.sched.Cancel()
 	c.read.close()
+
 	c.write.respChOnce.Do(func() {
 		close(c.write.respCh)
-		go c.send(frame{
-			connIdx: c.idx,
-			options: optClosed,
-		})
+		go func() {
+			if resp, err := c.send(frame{
+				connIdx: c.idx,
+				options: optClosed,
+			}); err == nil {
+				resp.Body.Close()
+			}
+		}()
 	})
 	return nil
 }
 
+// dropWriteBuf discards unsent data of a closed conn
+func (c *ClientConn) dropWriteBuf() {
+	c.write.Lock()
+	c.write.reset()
+	c.write.Unlock()
+}
+
 func (c *ClientConn) Write(p []byte) (n int, err error) {
-REWRITE:
-	if c.read.err != nil {
-		return 0, c.read.err
+	if err := c.write.wait(c.dialer.MaxWriteBuffer, c.writeErr); err != nil {
+		return 0, err
 	}
 
-	if c.read.closed {
+	c.write.Lock()
+	if c.write.closed() {
+		c.write.Unlock()
 		return 0, errClosedConn
 	}
-
-	if len(c.write.buf) > c.dialer.MaxWriteBuffer {
-		v.Eprint(c, " write buffer is full")
-		time.Sleep(time.Second)
-		goto REWRITE
+	if c.write.shut {
+		c.write.Unlock()
+		return 0, errShutdown
 	}
-
-	c.write.Lock()
 	c.write.sched.Reschedule(func() {
+		c.write.Lock()
 		c.write.survey.pendingSize = 1
+		c.write.Unlock()
 		c.schedSending()
 	}, time.Second)
-	c.write.buf = append(c.write.buf, p...)
+	c.write.append(p)
+	small := len(c.write.buf) < c.write.survey.pendingSize
 	c.write.Unlock()
 
-	if len(c.write.buf) < c.write.survey.pendingSize {
+	if small {
 		return len(p), nil
 	}
 
@@ -146,60 +187,114 @@ REWRITE:
 	return len(p), nil
 }
 
+// CloseWrite sends FIN to the server after buffered data, the server will read io.EOF
+func (c *ClientConn) CloseWrite() error {
+	c.write.Lock()
+	shut := c.write.shut
+	c.write.shut = true
+	c.write.Unlock()
+
+	if err := c.writeErr(); err != nil {
+		return err
+	}
+	if !shut {
+		c.schedSending()
+	}
+	return nil
+}
+
+func (c *ClientConn) writeErr() error {
+	return c.read.failure()
+}
+
 func (c *ClientConn) schedSending() {
 	atomic.AddInt64(&c.write.survey.reschedCount, 1)
 
-	if c.read.err != nil || c.read.closed {
+	if c.read.failure() != nil {
 		c.Close()
 		return
 	}
 
 	c.dialer.orchSendWriteBuf(c)
 	c.write.sched.Reschedule(func() {
+		c.write.Lock()
 		c.write.survey.pendingSize = 1
+		c.write.Unlock()
 		c.schedSending()
 	}, time.Second)
 }
 
+// sendWriteBuf takes frames under the lock and sends them without it,
+// so at most UploadWindow requests of the conn can be in flight, the server reorders frames
 func (c *ClientConn) sendWriteBuf() {
-	c.write.Lock()
-	defer c.write.Unlock()
+	c.write.window <- struct{}{}
+	defer func() { <-c.write.window }()
 
+	c.write.Lock()
 	if c.write.survey.pendingSize *= 2; c.write.survey.pendingSize > 1024 {
 		c.write.survey.pendingSize = 1024
 	}
 
-	if c.read.err != nil {
-		return
-	}
-
-	if c.read.closed {
+	if c.read.failure() != nil {
+		c.write.Unlock()
 		return
 	}
 
+	// Frames are kept until the server acknowledges them in responses,
+	// those not acknowledged in time are sent again along with new ones
 	f := frame{
 		idx:     rand.Uint32(),
 		connIdx: c.idx,
 		options: optSyncConnIdx,
-		next: &frame{
-			idx:     c.write.counter + 1,
-			connIdx: c.idx,
-			data:    c.write.buf,
-		},
+		next:    ackFrame(c.idx, c.read.acked()),
 	}
+	frames := c.write.due()
+	if nf := c.write.next(c.idx); nf != nil {
+		frames = append(frames, nf)
+	}
+	for tail, i := f.next, 0; i < len(frames); i++ {
+		x := *frames[i]
+		tail.next = &x
+		tail = tail.next
+	}
+	c.write.Unlock()
 
-	deadline := time.Now().Add(c.dialer.Timeout - time.Second)
-	for {
+	// The frame is resent until the deadline, the server keeps the session
+	// during outages shorter than its timeout and drops duplicated frames
+	deadline, byWriter := c.write.sendDeadline(time.Now().Add(c.dialer.Timeout - time.Second))
+	for backoff := 100 * time.Millisecond; ; {
 		if resp, err := c.send(f); err != nil {
-			if time.Now().After(deadline) {
+			if err == errGone || time.Now().After(deadline) {
+				if byWriter && err != errGone {
+					// Frames are kept and sent again after the deadline is extended,
+					// meanwhile Write returns the timeout
+					c.write.unsent(frames)
+					return
+				}
 				c.read.feedError(err)
 				return
 			}
+
+			v.VVprint(c, " send error, retry in ", backoff, ": ", err)
+			sleep := backoff
+			if d := time.Until(deadline); d < sleep {
+				sleep = d
+			}
+			time.Sleep(sleep)
+			if backoff *= 2; backoff > 2*time.Second {
+				backoff = 2 * time.Second
+			}
 		} else {
-			c.write.buf = c.write.buf[:0]
-			c.write.counter++
+			for _, f := range frames {
+				countFrame(true, len(f.data))
+			}
 			func() {
-				defer func() { recover() }()
+				defer func() {
+					if recover() != nil {
+						// respCh has been closed
+						resp.Body.Close()
+					}
+				}()
 				select {
 				case c.write.respCh <- resp.Body:
 				default:
@@ -215,42 +310,21 @@ func (c *ClientConn) sendWriteBuf() {
 }
 
 func (c *ClientConn) send(f frame) (resp *http.Response, err error) {
-	client := &http.Client{
-		Timeout:   c.dialer.Timeout,
-		Transport: c.dialer.Transport,
-	}
-
 	body := f.marshal(c.read.blk)
-	path := "http://" + c.dialer.endpoint + c.dialer.Path()
-	req, _ := http.NewRequest("POST", path, bytes.NewReader(body))
-
-	if parts := strings.Split(c.dialer.URLHeader, "="); len(parts) == 2 {
-		v.Vprint(parts)
-		req.Header.Add(parts[0], parts[1])
-	}
 
 	if len(body) > 1024*4 {
 		// log of sending big payload
 		v.VVVprint(c, " heavy sending ", float64(len(body))/1024, "K")
 	}
 
-	resp, err = client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		xx, _ := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		return nil, fmt.Errorf("remote is unavailable: %s, resp: %v", resp.Status, strconv.Quote(string(xx)))
-	}
-	return resp, nil
+	return c.dialer.post(body, c.gotConn)
 }
 
 func (c *ClientConn) respLoop() {
 	for body := range c.write.respCh {
 		k := sched.Schedule(func() { body.Close() }, c.dialer.Timeout)
 		if n, _ := c.read.feedframes(body); n == 0 {
-			c.write.survey.lastIsPositive = false
+			atomic.StoreInt32(&c.write.survey.lastIsPositive, 0)
 		}
 		k.Cancel()
 		body.Close()
@@ -259,6 +333,9 @@ func (c *ClientConn) respLoop() {
 }
 
 func (c *ClientConn) Read(p []byte) (n int, err error) {
+	if c.write.closed() {
+		return 0, errClosedConn
+	}
 	return c.read.Read(p)
 }
 
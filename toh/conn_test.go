@@ -1,8 +1,11 @@
 package toh
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -14,15 +17,17 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 var debugFlag = flag.Bool("debug", false, "")
 
-func init() {
+func TestMain(m *testing.M) {
 	flag.Parse()
 	debug = *debugFlag
+	os.Exit(m.Run())
 }
 
 func TestClientConn(t *testing.T) {
@@ -70,6 +75,354 @@ func TestReadDeadline(t *testing.T) {
 	select {}
 }
 
+func TestWriteDeadline(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		p := make([]byte, 2)
+		io.ReadFull(conn, p)
+		got <- p
+	}()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{1})
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.Write([]byte{2}); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal(err)
+	}
+
+	// the conn still works after the deadline is extended
+	conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write([]byte{3}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-got:
+		if p[0] != 1 || p[1] != 3 {
+			t.Fatal(p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestCloseLinger(t *testing.T) {
+	defer func(n int) { MaxReadBufferSize = n }(MaxReadBufferSize)
+	MaxReadBufferSize = 16 << 10
+
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	closed := make(chan bool)
+	got := make(chan []byte, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		<-closed
+		buf, _ := ioutil.ReadAll(conn)
+		got <- buf
+	}()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 256<<10)
+	rand.Read(data)
+	conn.Write(data)
+	conn.(*ClientConn).CloseWrite()
+
+	// the server is not reading, so data can't be delivered before Close returns
+	start := time.Now()
+	conn.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("Close blocks for", d)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != errClosedConn {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte{1}); err != errClosedConn {
+		t.Fatal(err)
+	}
+	close(closed)
+
+	select {
+	case buf := <-got:
+		if !bytes.Equal(buf, data) {
+			t.Fatal(len(buf))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+type slowTransport struct{ inflight, max int32 }
+
+func (tr *slowTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	n := atomic.AddInt32(&tr.inflight, 1)
+	defer atomic.AddInt32(&tr.inflight, -1)
+	for m := atomic.LoadInt32(&tr.max); n > m && !atomic.CompareAndSwapInt32(&tr.max, m, n); m = atomic.LoadInt32(&tr.max) {
+	}
+	// a high latency link, where uploads are pipelined and reordered
+	time.Sleep(time.Duration(100+rand.Intn(50)) * time.Millisecond)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestUploadWindow(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, _ := ln.Accept()
+		io.Copy(conn, conn)
+		CloseWrite(conn)
+	}()
+
+	tr := &slowTransport{}
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithTransport(tr), WithUploadWindow(4)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 256<<10)
+	rand.Read(data)
+	go func() {
+		// new data arrive while previous uploads are in flight
+		for p := data; len(p) > 0; p = p[16<<10:] {
+			if _, err := conn.Write(p[:16<<10]); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(60 * time.Millisecond)
+		}
+		CloseWrite(conn)
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatal(err, len(buf))
+	}
+	if atomic.LoadInt32(&tr.max) < 2 {
+		t.Fatal("uploads are not pipelined")
+	}
+}
+
+// lossyTransport is a link slower than initialRTO, where every 5th response is lost
+type lossyTransport struct{ n int32 }
+
+func (tr *lossyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	time.Sleep(time.Duration(1000+rand.Intn(200)) * time.Millisecond)
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err == nil && atomic.AddInt32(&tr.n, 1)%5 == 0 {
+		resp.Body.Close()
+		return nil, errors.New("response lost")
+	}
+	return resp, err
+}
+
+func TestLossyResend(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, _ := ln.Accept()
+		io.Copy(conn, conn)
+		CloseWrite(conn)
+	}()
+
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithTransport(&lossyTransport{}), WithUploadWindow(4)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sent, resent := Metrics().FramesSent, Metrics().ResentFrames
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	go func() {
+		// frames are sent over many round trips
+		for p := data; len(p) > 0; p = p[1<<10:] {
+			if _, err := conn.Write(p[:1<<10]); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		CloseWrite(conn)
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatal(err, len(buf))
+	}
+	// Frames are not resent every initialRTO once the round trip time is known
+	sent, resent = Metrics().FramesSent-sent, Metrics().ResentFrames-resent
+	if resent*5 > sent*2 {
+		t.Fatal("resent ", resent, " of ", sent, " frames")
+	}
+}
+
+// flakyProxy relays TCP connections to target, while it is down new connections are refused
+// and existing ones are broken, like a network outage or a restart of the server
+type flakyProxy struct {
+	net.Listener
+	target atomic.Value // string
+	mu     sync.Mutex
+	down   bool
+	conns  []net.Conn
+}
+
+func newFlakyProxy(t *testing.T, target string) *flakyProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &flakyProxy{Listener: ln}
+	p.target.Store(target)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			u, err := net.Dial("tcp", p.target.Load().(string))
+			p.mu.Lock()
+			if err != nil || p.down {
+				p.mu.Unlock()
+				c.Close()
+				if u != nil {
+					u.Close()
+				}
+				continue
+			}
+			p.conns = append(p.conns, c, u)
+			p.mu.Unlock()
+			go func() { io.Copy(u, c); u.Close() }()
+			go func() { io.Copy(c, u); c.Close() }()
+		}
+	}()
+	return p
+}
+
+func (p *flakyProxy) setDown(down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down = down
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func TestResume(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", WithInactiveTimeout(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, _ := ln.Accept()
+		io.Copy(conn, conn)
+		CloseWrite(conn)
+	}()
+
+	p := newFlakyProxy(t, ln.Addr().String())
+	defer p.Close()
+	conn, err := NewDialer("tcp", p.Addr().String(), WithInactiveTimeout(10*time.Second)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	go func() {
+		// the link is broken for a while in the middle of the stream, which is shorter than the timeout
+		for i, p := 0, data; len(p) > 0; i, p = i+1, p[4<<10:] {
+			if _, err := conn.Write(p[:4<<10]); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		CloseWrite(conn)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	p.setDown(true)
+	time.Sleep(2 * time.Second)
+	p.setDown(false)
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatal(err, len(buf))
+	}
+}
+
+func TestResumeGone(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, _ := ln.Accept()
+		io.Copy(conn, conn)
+	}()
+
+	p := newFlakyProxy(t, ln.Addr().String())
+	defer p.Close()
+	conn, err := NewDialer("tcp", p.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server restarts and knows nothing about the conn, links to the old one are broken
+	restarted, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	p.target.Store(restarted.Addr().String())
+	p.setDown(false)
+
+	conn.Write([]byte("b"))
+	if _, err := conn.Read(buf); err != errGone {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("c")); err != errGone {
+		t.Fatal(err)
+	}
+}
+
 func TestHTTPServer(t *testing.T) {
 	ready := make(chan bool)
 	var ln net.Listener
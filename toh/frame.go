@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math/rand"
 	"time"
 
 	"github.com/coyove/common/sched"
@@ -18,17 +19,35 @@ const (
 	optHello
 	optPing
 	optClosed
+	optFIN // the sender won't write any more, set on data frames
+	optAck // data is the idx of the last frame received in order
+)
+
+// Frames not acknowledged in the retransmission timeout are sent again, the timeout
+// is derived from the round trip time and doubled every time a frame is resent
+var (
+	initialRTO = time.Second
+	minRTO     = 200 * time.Millisecond
+	maxRTO     = 30 * time.Second
 )
 
 type frame struct {
 	connIdx uint64
 	idx     uint32
 	options byte
-	future  bool
+	sent    time.Time
+	rto     time.Duration // the frame is resent if not acknowledged in rto, which is doubled every time
+	resent  bool
 	data    []byte
 	next    *frame
 }
 
+func ackFrame(connIdx uint64, idx uint32) *frame {
+	f := &frame{idx: rand.Uint32() | 1, connIdx: connIdx, options: optAck, data: make([]byte, 4)}
+	binary.BigEndian.PutUint32(f.data, idx)
+	return f
+}
+
 // connection id 8b | data idx 4b | data length 4b | hash 3b | option 1b
 func (f *frame) marshal(blk cipher.Block) []byte {
 	buf := [20]byte{}
@@ -36,7 +55,8 @@ func (f *frame) marshal(blk cipher.Block) []byte {
 	binary.BigEndian.PutUint64(buf[4:], f.connIdx)
 
 	gcm, _ := cipher.NewGCM(blk)
-	x := gcm.Seal(f.data[:0], buf[:12], f.data, nil)
+	// Seal into a new buffer, f may be marshalled again when resending
+	x := gcm.Seal(nil, buf[:12], f.data, nil)
 	binary.LittleEndian.PutUint32(buf[12:], uint32(len(x)))
 	buf[16] = f.options
 
@@ -57,6 +77,15 @@ func (f *frame) marshal(blk cipher.Block) []byte {
 	return p.Bytes()
 }
 
+// checkHeader reports whether the frame header was encrypted by blk
+func checkHeader(header [20]byte, blk cipher.Block) bool {
+	blk.Decrypt(header[4:], header[4:])
+	blk.Decrypt(header[:], header[:])
+
+	h := crc32.Checksum(header[:17], crc32.IEEETable)
+	return header[17] == byte(h) && header[18] == byte(h>>8) && header[19] == byte(h>>16)
+}
+
 func parseframe(r io.ReadCloser, blk cipher.Block) (f frame, ok bool) {
 	k := sched.Schedule(func() {
 		v.VVprint("[ParseFrame] waiting too long")
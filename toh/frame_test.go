@@ -45,7 +45,7 @@ func TestFrame(t *testing.T) {
 			f = f.next
 		}
 
-		r := ioutil.NopCloser(root.marshal(blk))
+		r := ioutil.NopCloser(bytes.NewReader(root.marshal(blk)))
 
 		for {
 			f2, ok := parseframe(r, blk)
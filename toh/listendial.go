@@ -1,6 +1,7 @@
 package toh
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"fmt"
@@ -22,7 +23,16 @@ type Listener struct {
 	connsmu      sync.Mutex
 	httpServeErr chan error
 	pendingConns chan net.Conn
-	blk          cipher.Block
+	keys         []listenerKey
+	keysmu       sync.RWMutex
+	active       map[net.Conn]bool
+	draining     bool
+	limits       Limits
+	perIP        map[string]int
+	perUser      map[string]int
+	newConns     float64 // tokens of NewConnRate
+	newConnsLast time.Time
+	proxies      []*net.IPNet // trusted proxies, X-Forwarded-For from them is honoured
 
 	OnBadRequest http.HandlerFunc
 	CommonOptions
@@ -36,6 +46,160 @@ func (l *Listener) Close() error {
 	return l.ln.Close()
 }
 
+// Shutdown stops accepting new connections and waits for delivered ones to be closed,
+// if ctx is done before that, remaining connections will be closed forcefully
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.connsmu.Lock()
+	l.draining = true
+	l.connsmu.Unlock()
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		l.connsmu.Lock()
+		n := len(l.active)
+		l.connsmu.Unlock()
+
+		if n == 0 {
+			return l.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			l.connsmu.Lock()
+			conns := make([]net.Conn, 0, len(l.active))
+			for c := range l.active {
+				conns = append(conns, c)
+			}
+			l.connsmu.Unlock()
+
+			v.Vprint("listener shutdown, force closing ", len(conns), " connections")
+			for _, c := range conns {
+				c.Close()
+			}
+			l.Close()
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// trackedConn removes itself from the listener's active connections when closed
+type trackedConn struct {
+	net.Conn
+	ln      *Listener
+	ip      string
+	user    string
+	hasUser bool // user is counted, websocket connections know their users after the first read
+}
+
+// admit checks limits for conn from ip and counts it as active, connsmu must be held
+func (l *Listener) admit(conn net.Conn, ip, user string, hasUser bool) (*trackedConn, error) {
+	lim := l.limits
+
+	if lim.NewConnRate > 0 {
+		burst := float64(lim.NewConnBurst)
+		if burst <= 0 {
+			burst = lim.NewConnRate
+		}
+		if burst < 1 {
+			// a rate below 1 still admits one connection at a time
+			burst = 1
+		}
+		now := time.Now()
+		if l.newConnsLast.IsZero() {
+			l.newConns = burst
+		} else if l.newConns += now.Sub(l.newConnsLast).Seconds() * lim.NewConnRate; l.newConns > burst {
+			l.newConns = burst
+		}
+		l.newConnsLast = now
+	}
+
+	switch {
+	case l.draining:
+		return nil, fmt.Errorf("listener is shutting down")
+	case lim.MaxConns > 0 && len(l.active) >= lim.MaxConns:
+		return nil, fmt.Errorf("too many connections")
+	case lim.MaxConnsPerIP > 0 && l.perIP[ip] >= lim.MaxConnsPerIP:
+		return nil, fmt.Errorf("too many connections from %s", ip)
+	case hasUser && lim.MaxConnsPerUser > 0 && l.perUser[user] >= lim.MaxConnsPerUser:
+		return nil, fmt.Errorf("too many connections of user %q", user)
+	case lim.NewConnRate > 0 && l.newConns < 1:
+		return nil, fmt.Errorf("too many new connections")
+	}
+
+	if lim.NewConnRate > 0 {
+		l.newConns--
+	}
+	c := &trackedConn{Conn: conn, ln: l, ip: ip, user: user, hasUser: hasUser}
+	l.active[c] = true
+	l.perIP[ip]++
+	if hasUser {
+		l.perUser[user]++
+	}
+	return c, nil
+}
+
+// claimUser counts c as a connection of user
+func (c *trackedConn) claimUser(user string) error {
+	l := c.ln
+	l.connsmu.Lock()
+	defer l.connsmu.Unlock()
+
+	if lim := l.limits.MaxConnsPerUser; lim > 0 && l.perUser[user] >= lim {
+		return fmt.Errorf("too many connections of user %q", user)
+	}
+	if l.active[c] && !c.hasUser {
+		c.user, c.hasUser = user, true
+		l.perUser[user]++
+	}
+	return nil
+}
+
+func (c *trackedConn) ID() string {
+	if c, ok := c.Conn.(interface{ ID() string }); ok {
+		return c.ID()
+	}
+	return ""
+}
+
+func (c *trackedConn) User() string {
+	if c, ok := c.Conn.(interface{ User() string }); ok {
+		return c.User()
+	}
+	return ""
+}
+
+func (c *trackedConn) Buffered() int {
+	if c, ok := c.Conn.(interface{ Buffered() int }); ok {
+		return c.Buffered()
+	}
+	return 0
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *trackedConn) Close() error {
+	l := c.ln
+	l.connsmu.Lock()
+	if l.active[c] {
+		delete(l.active, c)
+		if l.perIP[c.ip]--; l.perIP[c.ip] <= 0 {
+			delete(l.perIP, c.ip)
+		}
+		if c.hasUser {
+			if l.perUser[c.user]--; l.perUser[c.user] <= 0 {
+				delete(l.perUser, c.user)
+			}
+		}
+	}
+	l.connsmu.Unlock()
+	return c.Conn.Close()
+}
+
 func (l *Listener) Addr() net.Addr {
 	return l.ln.Addr()
 }
@@ -62,15 +226,22 @@ func Listen(network string, address string, options ...Option) (net.Listener, er
 		httpServeErr: make(chan error, 1),
 		pendingConns: make(chan net.Conn, 1024),
 		conns:        map[uint64]*ServerConn{},
+		active:       map[net.Conn]bool{},
+		perIP:        map[string]int{},
+		perUser:      map[string]int{},
 	}
 
 	for _, o := range options {
 		o(nil, l)
 	}
+	if err := l.limits.Validate(); err != nil {
+		ln.Close()
+		return nil, err
+	}
 
 	l.check()
 
-	l.blk, _ = aes.NewCipher([]byte(network + "0123456789abcdef")[:16])
+	l.SetKey(network)
 
 	go func() {
 		mux := http.NewServeMux()
@@ -96,15 +267,151 @@ func Listen(network string, address string, options ...Option) (net.Listener, er
 	return l, nil
 }
 
+type listenerKey struct {
+	user    string
+	key     string
+	blk     cipher.Block
+	current bool
+	retired time.Time // when the key stopped being current
+}
+
+// owns reports whether c was established with the key, requests can only act on connections of their keys
+func (k listenerKey) owns(c *ServerConn) bool {
+	return k.blk == c.read.blk
+}
+
+func newCipher(key string) cipher.Block {
+	blk, _ := aes.NewCipher([]byte(key + "0123456789abcdef")[:16])
+	return blk
+}
+
+// setKeys makes keys (user -> key) current, keys no longer current are kept for existing connections
+func (l *Listener) setKeys(keys map[string]string) {
+	var current, old []listenerKey
+
+	for _, k := range l.keys {
+		if k.current && keys[k.user] == k.key {
+			delete(keys, k.user)
+			current = append(current, k)
+		} else {
+			if k.current {
+				k.current, k.retired = false, time.Now()
+			}
+			old = append(old, k)
+		}
+	}
+	for user, key := range keys {
+		current = append(current, listenerKey{user: user, key: key, blk: newCipher(key), current: true})
+	}
+
+	if len(old) > 8 {
+		old = old[:8]
+	}
+	l.keys = append(current, old...)
+}
+
+// SetKey changes the key of the listener, new connections must use the new key,
+// while existing ones can still use the old keys they were established with
+func (l *Listener) SetKey(key string) {
+	l.keysmu.Lock()
+	defer l.keysmu.Unlock()
+
+	keys := map[string]string{"": key}
+	for _, k := range l.keys {
+		if k.current && k.user != "" {
+			keys[k.user] = k.key
+		}
+	}
+	l.setKeys(keys)
+}
+
+// SetUsers changes keys of users (user -> key), connections using them will be named after their users.
+// Like SetKey, existing connections are not affected
+func (l *Listener) SetUsers(users map[string]string) {
+	l.keysmu.Lock()
+	defer l.keysmu.Unlock()
+
+	keys := map[string]string{}
+	for user, key := range users {
+		keys[user] = key
+	}
+	for _, k := range l.keys {
+		if k.current && k.user == "" {
+			keys[""] = k.key
+		}
+	}
+	l.setKeys(keys)
+}
+
+// matchKey returns the key which encrypted the header, keys no longer current expire after Timeout
+// unless there are connections still using them
+func (l *Listener) matchKey(header [20]byte) (listenerKey, bool) {
+	l.keysmu.RLock()
+	keys := l.keys
+	l.keysmu.RUnlock()
+
+	for _, k := range keys {
+		if checkHeader(header, k.blk) {
+			if !k.current && time.Since(k.retired) > l.Timeout && !l.keyInUse(k) {
+				return listenerKey{}, false
+			}
+			return k, true
+		}
+	}
+	return listenerKey{}, false
+}
+
+func (l *Listener) keyInUse(k listenerKey) bool {
+	l.connsmu.Lock()
+	defer l.connsmu.Unlock()
+	for _, c := range l.conns {
+		if k.owns(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Listener) currentKeys() []listenerKey {
+	l.keysmu.RLock()
+	defer l.keysmu.RUnlock()
+
+	var keys []listenerKey
+	for _, k := range l.keys {
+		if k.current {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// SetOptions applies options to the listener, existing connections are not affected
+func (l *Listener) SetOptions(options ...Option) {
+	l.connsmu.Lock()
+	defer l.connsmu.Unlock()
+
+	for _, o := range options {
+		o(nil, l)
+	}
+	l.check()
+}
+
 type Dialer struct {
 	endpoint string
 	orch     chan *ClientConn
+	orchOnce sync.Once
+	orchmu   sync.RWMutex
+	closed   bool
+	done     chan struct{}
 	blk      cipher.Block
+	pool     pool
 
 	Transport   http.RoundTripper
-	WebSocket   bool
+	Protocol    string
+	WebSocket   bool // Deprecated: use Protocol, it means TransportWebSocket if Protocol is TransportHTTP
 	URLHeader   string
 	PathPattern string
+	PoolOptions
 	CommonOptions
 }
 
@@ -112,8 +419,9 @@ func NewDialer(network string, endpoint string, options ...Option) *Dialer {
 	d := &Dialer{
 		endpoint: endpoint,
 		orch:     make(chan *ClientConn, 128),
+		done:     make(chan struct{}),
 	}
-	d.blk, _ = aes.NewCipher([]byte(network + "0123456789abcdef")[:16])
+	d.blk = newCipher(network)
 
 	for _, o := range options {
 		o(d, nil)
@@ -122,17 +430,34 @@ func NewDialer(network string, endpoint string, options ...Option) *Dialer {
 	if d.Transport == nil {
 		d.Transport = http.DefaultTransport
 	}
-	if !d.WebSocket {
-		d.startOrch()
+	if d.Protocol == "" {
+		d.Protocol = TransportHTTP
 	}
 	if !strings.HasPrefix(d.PathPattern, "/") {
 		d.PathPattern = "/"
 	}
+	if d.UploadWindow <= 0 {
+		d.UploadWindow = 1
+	}
 	d.check()
+	d.initPool()
 
 	return d
 }
 
+// Close stops the orchestrator and closes idle connections of the pool. Connections dialed
+// before are not affected, but they are no longer batched by the orchestrator
+func (d *Dialer) Close() error {
+	d.orchmu.Lock()
+	defer d.orchmu.Unlock()
+	if !d.closed {
+		d.closed = true
+		close(d.done)
+		d.pool.client.CloseIdleConnections()
+	}
+	return nil
+}
+
 func (d *Dialer) Path() string {
 	r := strconv.FormatUint(rand.Uint64(), 10)
 	if strings.HasSuffix(d.PathPattern, "/") {
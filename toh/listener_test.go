@@ -0,0 +1,145 @@
+package toh
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListenerKeys(t *testing.T) {
+	ln, err := Listen("a", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := ln.(*Listener)
+	l.SetUsers(map[string]string{"bob": "b"})
+
+	c, err := NewDialer("a", l.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	idx := c.(*ClientConn).idx
+
+	// bob can neither ping nor close a connection of the default key
+	bob := NewDialer("b", l.Addr().String())
+	ping := frame{options: optPing, data: make([]byte, 8)}
+	binary.BigEndian.PutUint64(ping.data, idx)
+	resp, err := bob.post(ping.marshal(bob.blk), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := parseframe(resp.Body, bob.blk); !ok || len(f.data) != 10 || binary.BigEndian.Uint16(f.data) != PING_CLOSED {
+		t.Fatal(f, ok)
+	}
+	resp.Body.Close()
+
+	if resp, err = bob.post((&frame{idx: 1, connIdx: idx, options: optClosed}).marshal(bob.blk), nil); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	l.connsmu.Lock()
+	sc := l.conns[idx]
+	l.connsmu.Unlock()
+	if sc == nil || sc.read.isClosed() {
+		t.Fatal("connection is closed by another key")
+	}
+
+	// The retired key works while its connection lives, then expires after Timeout
+	old := l.Cipher()
+	l.SetKey("a2")
+	l.Timeout = 50 * time.Millisecond
+	var h [20]byte
+	copy(h[:], (&frame{idx: 1, connIdx: 1}).marshal(old))
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := l.matchKey(h); !ok {
+		t.Fatal("key of a live connection expired")
+	}
+	sc.close()
+	if _, ok := l.matchKey(h); ok {
+		t.Fatal("retired key is still valid")
+	}
+}
+
+func TestListenerLimits(t *testing.T) {
+	if _, err := Listen("a", "127.0.0.1:0", WithLimits(Limits{NewConnRate: -1})); err == nil {
+		t.Fatal("negative limits should be rejected")
+	}
+
+	type admit struct{ ip, user string }
+	for _, c := range []struct {
+		limits Limits
+		admits []admit
+		ok     []bool
+	}{
+		{Limits{}, []admit{{"1", "a"}, {"1", "a"}, {"1", "a"}}, []bool{true, true, true}},
+		{Limits{MaxConns: 2}, []admit{{"1", "a"}, {"2", "b"}, {"3", "c"}}, []bool{true, true, false}},
+		{Limits{MaxConnsPerIP: 1}, []admit{{"1", "a"}, {"1", "b"}, {"2", "a"}}, []bool{true, false, true}},
+		{Limits{MaxConnsPerUser: 1}, []admit{{"1", "a"}, {"2", "a"}, {"1", "b"}, {"1", ""}, {"2", ""}}, []bool{true, false, true, true, false}},
+		{Limits{NewConnRate: 0.001}, []admit{{"1", "a"}, {"2", "b"}}, []bool{true, false}},
+		{Limits{NewConnRate: 0.001, NewConnBurst: 2}, []admit{{"1", "a"}, {"2", "b"}, {"3", "c"}}, []bool{true, true, false}},
+	} {
+		ln, err := Listen("a", "127.0.0.1:0", WithLimits(c.limits))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := ln.(*Listener)
+
+		var conns []net.Conn
+		for i, a := range c.admits {
+			p, _ := net.Pipe()
+			conn, err := l.Admit(p, a.ip, a.user)
+			if (err == nil) != c.ok[i] {
+				t.Fatal(c.limits, i, err)
+			}
+			if err == nil {
+				conns = append(conns, conn)
+			}
+		}
+
+		// closed connections are released, but not the rate
+		for _, conn := range conns {
+			conn.Close()
+		}
+		p, _ := net.Pipe()
+		if conn, err := l.Admit(p, "1", "a"); (err == nil) != (c.limits.NewConnRate == 0) {
+			t.Fatal(c.limits, err)
+		} else if err == nil {
+			conn.Close()
+		}
+		ln.Close()
+	}
+}
+
+func TestListenerRemoteAddr(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	_, trusted6, _ := net.ParseCIDR("fd00::/8")
+	l := &Listener{proxies: []*net.IPNet{trusted, trusted6}}
+
+	for _, c := range []struct {
+		peer string
+		xff  []string
+		addr string
+	}{
+		{"1.2.3.4:5", nil, "1.2.3.4:5"},
+		{"1.2.3.4:5", []string{"9.9.9.9"}, "1.2.3.4:5"}, // untrusted peer can't spoof
+		{"10.0.0.1:5", nil, "10.0.0.1:5"},
+		{"10.0.0.1:5", []string{"9.9.9.9"}, "9.9.9.9:0"},
+		{"10.0.0.1:5", []string{"9.9.9.9, 10.0.0.2"}, "9.9.9.9:0"},
+		{"10.0.0.1:5", []string{"6.6.6.6, 9.9.9.9, 10.0.0.2"}, "9.9.9.9:0"}, // the rightmost untrusted one
+		{"10.0.0.1:5", []string{"6.6.6.6", "9.9.9.9"}, "9.9.9.9:0"},
+		{"10.0.0.1:5", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3:0"},
+		{"10.0.0.1:5", []string{"9.9.9.9, junk"}, "10.0.0.1:5"},
+		{"[fd00::1]:5", []string{"2001:db8::1"}, "[2001:db8::1]:0"},
+		{"bad", []string{"9.9.9.9"}, ":0"},
+	} {
+		r := &http.Request{RemoteAddr: c.peer, Header: http.Header{"X-Forwarded-For": c.xff}}
+		if addr := l.remoteAddr(r).String(); addr != c.addr {
+			t.Fatal(c.peer, c.xff, addr)
+		}
+	}
+}
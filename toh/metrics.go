@@ -0,0 +1,86 @@
+package toh
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DialBuckets are the upper bounds of dial latency histogram in seconds
+var DialBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Counters are process-wide statistics of all toh connections
+type Counters struct {
+	ClientConns   int64 // active ClientConns
+	ServerConns   int64 // active ServerConns
+	BytesSent     int64 // payload bytes sent in frames
+	BytesRecv     int64 // payload bytes received in frames
+	FramesSent    int64
+	FramesRecv    int64
+	OrchPings     int64 // connections pinged in batch by orchestrators
+	OrchDirects   int64 // connections sent directly by orchestrators
+	OrchPositives int64 // pings telling there is data to read
+	WriteBuffered int64 // bytes waiting in write buffers
+	DroppedFrames int64 // frames dropped because of MaxReadBufferSize, they will be resent
+	ResentFrames  int64 // frames sent again because they were not acknowledged in time
+	Errors        int64 // connections broken by errors
+
+	DialCount   int64
+	DialSeconds float64
+	DialBuckets []int64 // cumulative counts of DialBuckets
+}
+
+var counters struct {
+	Counters
+	dialNanos   int64
+	dialBuckets []int64
+}
+
+func init() {
+	counters.dialBuckets = make([]int64, len(DialBuckets))
+}
+
+// Metrics returns a snapshot of the counters
+func Metrics() Counters {
+	c := Counters{
+		ClientConns:   atomic.LoadInt64(&counters.ClientConns),
+		ServerConns:   atomic.LoadInt64(&counters.ServerConns),
+		BytesSent:     atomic.LoadInt64(&counters.BytesSent),
+		BytesRecv:     atomic.LoadInt64(&counters.BytesRecv),
+		FramesSent:    atomic.LoadInt64(&counters.FramesSent),
+		FramesRecv:    atomic.LoadInt64(&counters.FramesRecv),
+		OrchPings:     atomic.LoadInt64(&counters.OrchPings),
+		OrchDirects:   atomic.LoadInt64(&counters.OrchDirects),
+		OrchPositives: atomic.LoadInt64(&counters.OrchPositives),
+		WriteBuffered: atomic.LoadInt64(&counters.WriteBuffered),
+		DroppedFrames: atomic.LoadInt64(&counters.DroppedFrames),
+		ResentFrames:  atomic.LoadInt64(&counters.ResentFrames),
+		Errors:        atomic.LoadInt64(&counters.Errors),
+		DialCount:     atomic.LoadInt64(&counters.DialCount),
+		DialSeconds:   float64(atomic.LoadInt64(&counters.dialNanos)) / 1e9,
+		DialBuckets:   make([]int64, len(DialBuckets)),
+	}
+	for i := range c.DialBuckets {
+		c.DialBuckets[i] = atomic.LoadInt64(&counters.dialBuckets[i])
+	}
+	return c
+}
+
+func countFrame(sent bool, n int) {
+	if sent {
+		atomic.AddInt64(&counters.FramesSent, 1)
+		atomic.AddInt64(&counters.BytesSent, int64(n))
+	} else {
+		atomic.AddInt64(&counters.FramesRecv, 1)
+		atomic.AddInt64(&counters.BytesRecv, int64(n))
+	}
+}
+
+func countDial(d time.Duration) {
+	atomic.AddInt64(&counters.DialCount, 1)
+	atomic.AddInt64(&counters.dialNanos, int64(d))
+	for i, b := range DialBuckets {
+		if d.Seconds() <= b {
+			atomic.AddInt64(&counters.dialBuckets[i], 1)
+		}
+	}
+}
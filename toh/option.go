@@ -1,7 +1,9 @@
 package toh
 
 import (
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"time"
 )
@@ -20,6 +22,32 @@ func (d *CommonOptions) check() {
 	}
 }
 
+// Limits caps connections a listener accepts, 0 means unlimited.
+// Connections over the limits are rejected with 503 Service Unavailable
+type Limits struct {
+	MaxConns        int     `json:"max_conns"`          // total connections
+	MaxConnsPerIP   int     `json:"max_conns_per_ip"`   // connections from each remote IP
+	MaxConnsPerUser int     `json:"max_conns_per_user"` // connections of each user, see Listener.SetUsers
+	NewConnRate     float64 `json:"new_conn_rate"`      // new connections per second
+	NewConnBurst    int     `json:"new_conn_burst"`     // new connections allowed at once, NewConnRate by default
+}
+
+// Validate returns an error if any of the limits is negative
+func (l Limits) Validate() error {
+	for name, v := range map[string]float64{
+		"max_conns":          float64(l.MaxConns),
+		"max_conns_per_ip":   float64(l.MaxConnsPerIP),
+		"max_conns_per_user": float64(l.MaxConnsPerUser),
+		"new_conn_rate":      l.NewConnRate,
+		"new_conn_burst":     float64(l.NewConnBurst),
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return nil
+}
+
 type Option func(d *Dialer, ln *Listener)
 
 var (
@@ -41,9 +69,23 @@ var (
 		})
 	}
 	WithWebSocket = func(ws bool) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d == nil {
+				return
+			}
+			d.WebSocket = ws
+			if ws {
+				d.Protocol = TransportWebSocket
+			} else if d.Protocol == TransportWebSocket {
+				d.Protocol = TransportHTTP
+			}
+		})
+	}
+	WithProtocol = func(name string) Option {
 		return Option(func(d *Dialer, ln *Listener) {
 			if d != nil {
-				d.WebSocket = ws
+				d.Protocol = name
+				d.WebSocket = name == TransportWebSocket
 			}
 		})
 	}
@@ -71,6 +113,48 @@ var (
 			}
 		})
 	}
+	WithMaxIdleConns = func(n int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.MaxIdleConns = n
+			}
+		})
+	}
+	WithMaxActiveConns = func(n int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.MaxActiveConns = n
+			}
+		})
+	}
+	WithMaxInflight = func(n int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.MaxInflight = n
+			}
+		})
+	}
+	WithUploadWindow = func(n int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.UploadWindow = n
+			}
+		})
+	}
+	WithLimits = func(limits Limits) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.limits = limits
+			}
+		})
+	}
+	WithTrustedProxies = func(proxies []*net.IPNet) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.proxies = proxies
+			}
+		})
+	}
 	WithBadRequest = func(callback http.HandlerFunc) Option {
 		return Option(func(d *Dialer, ln *Listener) {
 			if ln != nil {
@@ -37,11 +37,26 @@ func (d *Dialer) startOrch() {
 					conns[c.idx] = c
 				case <-time.After((time.Millisecond) * 50):
 					break READ
+				case <-d.done:
+					// Nothing is queued after the dialer is closed, the rest are sent directly
+					for {
+						select {
+						case c := <-d.orch:
+							conns[c.idx] = c
+						default:
+							for _, c := range conns {
+								go c.sendWriteBuf()
+							}
+							return
+						}
+					}
 				}
 			}
 
 			if loopcount%20 == 0 || positives > 0 {
-				v.VVprint("orch pings: ", pings, "(+", positives, "), directs: ", directs)
+				ps := d.PoolStats()
+				v.VVprint("orch pings: ", pings, "(+", positives, "), directs: ", directs,
+					", requests: ", ps.Requests, " (new conns: ", ps.NewConns, ", reused: ", ps.ReusedConns, ", inflight: ", ps.Inflight, ")")
 				directs, pings, positives = 0, 0, 0
 			}
 
@@ -54,11 +69,12 @@ func (d *Dialer) startOrch() {
 			var lastconn *ClientConn
 
 			for k, conn := range conns {
-				if len(conn.write.buf) > 0 || conn.write.survey.lastIsPositive {
+				if conn.write.hasPending() || atomic.LoadInt32(&conn.write.survey.lastIsPositive) == 1 {
 					// For connections with actual data waiting to be sent, send them directly
 					go conn.sendWriteBuf()
 					delete(conns, k)
 					directs++
+					atomic.AddInt64(&counters.OrchDirects, 1)
 					continue
 				}
 
@@ -69,6 +85,7 @@ func (d *Dialer) startOrch() {
 			if len(conns) <= 3 {
 				for _, conn := range conns {
 					directs++
+					atomic.AddInt64(&counters.OrchDirects, 1)
 					go conn.sendWriteBuf()
 				}
 				lastconn = nil
@@ -81,6 +98,7 @@ func (d *Dialer) startOrch() {
 
 			pingframe := frame{options: optPing, data: p.Bytes()}
 			pings += p.Len() / 8
+			atomic.AddInt64(&counters.OrchPings, int64(p.Len()/8))
 
 			go func(pingframe frame, lastconn *ClientConn, conns map[uint64]*ClientConn) {
 				resp, err := lastconn.send(pingframe)
@@ -99,17 +117,19 @@ func (d *Dialer) startOrch() {
 					connState := binary.BigEndian.Uint16(f.data[i:])
 					connIdx := binary.BigEndian.Uint64(f.data[i+2:])
 
-					if c := conns[connIdx]; c != nil && !c.read.closed && c.read.err == nil {
+					if c := conns[connIdx]; c != nil && c.read.failure() == nil {
 						switch connState {
 						case PING_CLOSED:
+							// The server doesn't know the conn any more, as if its requests were answered with 410
 							v.VVprint(c, " server side has closed")
-							c.read.feedError(errClosedConn)
-							c.Close()
+							c.read.feedError(errGone)
+							c.close()
 						case PING_OK_VOID:
-							c.write.survey.lastIsPositive = false
+							atomic.StoreInt32(&c.write.survey.lastIsPositive, 0)
 						case PING_OK:
 							atomic.AddUint64(&positives, 1)
-							c.write.survey.lastIsPositive = true
+							atomic.AddInt64(&counters.OrchPositives, 1)
+							atomic.StoreInt32(&c.write.survey.lastIsPositive, 1)
 							go c.sendWriteBuf()
 						}
 					}
@@ -122,6 +142,12 @@ func (d *Dialer) startOrch() {
 }
 
 func (d *Dialer) orchSendWriteBuf(c *ClientConn) {
+	d.orchmu.RLock()
+	defer d.orchmu.RUnlock()
+	if d.closed {
+		go c.sendWriteBuf()
+		return
+	}
 	select {
 	case d.orch <- c:
 	default:
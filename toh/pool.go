@@ -0,0 +1,198 @@
+package toh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type PoolOptions struct {
+	MaxIdleConns   int // max idle keep-alive connections to the endpoint, 64 for the default transport
+	MaxActiveConns int // max connections (idle + active) to the endpoint, 0 means the transport's setting
+	MaxInflight    int // max concurrent requests of a Dialer, 0 means no limit
+	UploadWindow   int // max concurrent uploads of a ClientConn, 1 if not set
+}
+
+type PoolStats struct {
+	Requests    int64 // total requests sent
+	NewConns    int64 // requests which established a new connection
+	ReusedConns int64 // requests which reused a keep-alive connection
+	Inflight    int64 // requests waiting for their responses to be consumed
+}
+
+type pool struct {
+	client   *http.Client
+	url      string
+	header   http.Header
+	inflight chan struct{}
+	stats    PoolStats
+}
+
+func (d *Dialer) initPool() {
+	p := &d.pool
+	tr := d.Transport
+
+	// Settings of a custom transport are kept unless they are set explicitly
+	if t, ok := tr.(*http.Transport); ok {
+		idle := d.MaxIdleConns
+		if idle <= 0 && tr == http.DefaultTransport {
+			idle = 64
+		}
+		t = t.Clone()
+		if idle > 0 {
+			t.MaxIdleConns, t.MaxIdleConnsPerHost = idle, idle
+		}
+		if d.MaxActiveConns > 0 {
+			t.MaxConnsPerHost = d.MaxActiveConns
+		}
+		tr = t
+	}
+
+	p.client = &http.Client{Timeout: d.Timeout, Transport: tr}
+	p.url = (&url.URL{Scheme: "http", Host: d.endpoint}).String()
+	p.header = http.Header{}
+
+	if parts := strings.Split(d.URLHeader, "="); len(parts) == 2 {
+		p.header.Add(parts[0], parts[1])
+	}
+
+	if d.MaxInflight > 0 {
+		p.inflight = make(chan struct{}, d.MaxInflight)
+	}
+}
+
+// do sends req through the pool, gotConn is called with the connection which carries req if not nil
+func (p *pool) do(req *http.Request, gotConn func(httptrace.GotConnInfo)) (*http.Response, error) {
+	if p.inflight != nil {
+		t := time.NewTimer(p.client.Timeout)
+		select {
+		case p.inflight <- struct{}{}:
+			t.Stop()
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+			return nil, fmt.Errorf("too many requests in flight")
+		}
+	}
+
+	atomic.AddInt64(&p.stats.Requests, 1)
+	atomic.AddInt64(&p.stats.Inflight, 1)
+
+	for k, v := range p.header {
+		req.Header[k] = v
+	}
+
+	// A trace is built for every request, because WithClientTrace modifies it to call hooks in the context
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&p.stats.ReusedConns, 1)
+			} else {
+				atomic.AddInt64(&p.stats.NewConns, 1)
+			}
+			if gotConn != nil {
+				gotConn(info)
+			}
+		},
+	}
+	resp, err := p.client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+
+	// The underlying connection won't be available for other requests until the body is consumed,
+	// so the slot is released once the body is read to the end or closed
+	resp.Body = &pooledBody{ReadCloser: resp.Body, p: p}
+	return resp, nil
+}
+
+func (d *Dialer) post(body []byte, gotConn func(httptrace.GotConnInfo)) (*http.Response, error) {
+	req, _ := http.NewRequest("POST", d.pool.url+d.Path(), bytes.NewReader(body))
+	resp, err := d.pool.do(req, gotConn)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		xx, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("remote is unavailable: %s, resp: %v", resp.Status, strconv.Quote(string(xx)))
+	}
+	return resp, nil
+}
+
+// Ping sends an empty ping frame to the endpoint and returns the round trip time,
+// transports other than http may not serve frames, so they are probed by dialing a connection
+func (d *Dialer) Ping() (time.Duration, error) {
+	start := time.Now()
+	if d.protocol() != TransportHTTP {
+		conn, err := d.Dial()
+		if err != nil {
+			return 0, err
+		}
+		conn.Close()
+		return time.Since(start), nil
+	}
+	f := frame{options: optPing}
+
+	resp, err := d.post(f.marshal(d.blk), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if f, ok := parseframe(resp.Body, d.blk); !ok || f.options != optPing {
+		return 0, fmt.Errorf("invalid ping response")
+	}
+	return time.Since(start), nil
+}
+
+func (p *pool) release() {
+	atomic.AddInt64(&p.stats.Inflight, -1)
+	if p.inflight != nil {
+		<-p.inflight
+	}
+}
+
+func (d *Dialer) PoolStats() PoolStats {
+	return PoolStats{
+		Requests:    atomic.LoadInt64(&d.pool.stats.Requests),
+		NewConns:    atomic.LoadInt64(&d.pool.stats.NewConns),
+		ReusedConns: atomic.LoadInt64(&d.pool.stats.ReusedConns),
+		Inflight:    atomic.LoadInt64(&d.pool.stats.Inflight),
+	}
+}
+
+type pooledBody struct {
+	io.ReadCloser
+	p    *pool
+	once sync.Once
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.p.release)
+	}
+	return n, err
+}
+
+func (b *pooledBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.p.release)
+	return err
+}
@@ -0,0 +1,151 @@
+package toh
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	d := NewDialer("k", strings.TrimPrefix(s.URL, "http://"),
+		WithMaxInflight(1), WithInactiveTimeout(500*time.Millisecond))
+
+	// Reading the body to the end releases the slot without closing it
+	for i := 0; i < 3; i++ {
+		resp, err := d.post([]byte("x"), nil)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if buf, _ := ioutil.ReadAll(resp.Body); string(buf) != "ok" {
+			t.Fatal(string(buf))
+		}
+	}
+
+	ps := d.PoolStats()
+	if ps.Requests != 3 || ps.Inflight != 0 || ps.NewConns+ps.ReusedConns != 3 || ps.ReusedConns == 0 {
+		t.Fatal(ps)
+	}
+
+	// An unread body holds the slot, the next request gives up after the timeout
+	held, err := d.post([]byte("x"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := d.post([]byte("x"), nil); err == nil || time.Since(start) < 400*time.Millisecond {
+		t.Fatal(err, time.Since(start))
+	}
+	if ps := d.PoolStats(); ps.Inflight != 1 {
+		t.Fatal(ps)
+	}
+
+	held.Body.Close()
+	resp, err := d.post([]byte("x"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ps := d.PoolStats(); ps.Inflight != 0 || ps.Requests != 5 {
+		t.Fatal(ps)
+	}
+}
+
+func TestPoolTransport(t *testing.T) {
+	custom := &http.Transport{MaxIdleConns: 5, MaxIdleConnsPerHost: 3, MaxConnsPerHost: 100}
+	for _, c := range []struct {
+		tr                     http.RoundTripper
+		options                []Option
+		idle, idlePerHost, max int
+	}{
+		{nil, nil, 64, 64, 0},
+		{nil, []Option{WithMaxIdleConns(8), WithMaxActiveConns(16)}, 8, 8, 16},
+		{custom, nil, 5, 3, 100},
+		{custom, []Option{WithMaxActiveConns(16)}, 5, 3, 16},
+		{custom, []Option{WithMaxIdleConns(8)}, 8, 8, 100},
+	} {
+		options := c.options
+		if c.tr != nil {
+			options = append(options, WithTransport(c.tr))
+		}
+		tr := NewDialer("k", "127.0.0.1:1", options...).pool.client.Transport.(*http.Transport)
+		if tr.MaxIdleConns != c.idle || tr.MaxIdleConnsPerHost != c.idlePerHost || tr.MaxConnsPerHost != c.max {
+			t.Fatal(c.options, tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost)
+		}
+	}
+	if custom.MaxConnsPerHost != 100 || custom.MaxIdleConns != 5 {
+		t.Fatal("the transport of the caller is modified")
+	}
+}
+
+func TestDialerClose(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var echoes sync.WaitGroup
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			echoes.Add(1)
+			go func() { io.Copy(conn, conn); conn.Close(); echoes.Done() }()
+		}
+	}()
+
+	orchs := func() int {
+		buf := make([]byte, 1<<20)
+		return strings.Count(string(buf[:runtime.Stack(buf, true)]), "startOrch.func1()")
+	}
+	echo := func(conn net.Conn, msg string) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(msg))
+		if buf := make([]byte, len(msg)); func() error { _, err := io.ReadFull(conn, buf); return err }() != nil || string(buf) != msg {
+			t.Fatal(msg, string(buf))
+		}
+	}
+
+	n := orchs()
+	d := NewDialer("tcp", ln.Addr().String())
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(conn, "a")
+	if orchs() != n+1 {
+		t.Fatal("orchestrator is not started")
+	}
+
+	// the orchestrator exits, connections dialed before and after still work
+	d.Close()
+	for start := time.Now(); orchs() != n; time.Sleep(20 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("orchestrator is still running")
+		}
+	}
+	echo(conn, "b")
+	conn2, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(conn2, "c")
+
+	conn.Close()
+	conn2.Close()
+	echoes.Wait()
+}
@@ -126,22 +126,22 @@ func TestProxy(t *testing.T) {
 			up = ":10001"
 		}
 
-		tr := *http.DefaultTransport.(*http.Transport)
+		tr := http.DefaultTransport.(*http.Transport).Clone()
 		tr.MaxConnsPerHost = 100
 
 		u, _ := url.Parse("http://example.com")
 
 		dd = NewDialer("tcp", up,
-			WithTransport(&tr),
+			WithTransport(tr),
 			WithInactiveTimeout(time.Second*10),
 			WithWebSocket(ws),
-			WithPath("/aaa"))
+			WithPathPattern("/aaa"))
 
 		go http.ListenAndServe(":10000", new(client))
 
 		ln, _ := Listen("tcp", ":10001",
 			WithInactiveTimeout(time.Second*10),
-			WithPath("/aaa"),
+			WithPathPattern("/aaa"),
 			WithBadRequest(httputil.NewSingleHostReverseProxy(u).ServeHTTP))
 		for {
 			conn, _ := ln.Accept()
@@ -2,12 +2,12 @@ package toh
 
 import (
 	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coyove/common/waitobject"
@@ -16,10 +16,13 @@ import (
 
 var (
 	errClosedConn = fmt.Errorf("use of closed connection")
+	errShutdown   = fmt.Errorf("use of closed connection for writing")
+	errGone       = fmt.Errorf("connection has gone on the server, it may have restarted")
 	dummyTouch    = func(interface{}) interface{} { return 1 }
 )
 
-// Define the max pending bytes stored in memory, any further bytes will be written to disk
+// MaxReadBufferSize limits bytes received but not read yet, further frames are dropped
+// without being acked and the other side will resend them once the reader catches up
 var MaxReadBufferSize = 1024 * 1024 * 1
 
 type readConn struct {
@@ -35,6 +38,8 @@ type readConn struct {
 	closed       bool               // is readConn closed already
 	tag          byte               // tag, 'c' for readConn in ClientConn, 's' for readConn in ServerConn
 	counter      uint32             // counter, must be synced with the writer on the other side
+	eof          bool               // the other side has closed its writing, Read returns io.EOF once buf is drained
+	onAck        func(idx uint32)   // called with acks of the other side
 }
 
 func newReadConn(idx uint64, blk cipher.Block, tag byte) *readConn {
@@ -46,14 +51,39 @@ func newReadConn(idx uint64, blk cipher.Block, tag byte) *readConn {
 		blk:          blk,
 		ready:        waitobject.New(),
 	}
+	if tag == 'c' {
+		atomic.AddInt64(&counters.ClientConns, 1)
+	} else {
+		atomic.AddInt64(&counters.ServerConns, 1)
+	}
 	go r.readLoopRearrange()
 	return r
 }
 
+// lossReader remembers the read error, so a broken body can be told from invalid frames
+type lossReader struct {
+	io.ReadCloser
+	err error
+}
+
+func (r *lossReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
 func (c *readConn) feedframes(r io.ReadCloser) (datalen int, err error) {
 	count := 0
+	lr := &lossReader{ReadCloser: r}
 	for {
-		f, ok := parseframe(r, c.blk)
+		f, ok := parseframe(lr, c.blk)
+		if !ok && lr.err != nil {
+			// The rest of frames are lost, they will be resent because we don't ack them
+			v.Vprint(c, " broken frames: ", lr.err)
+			break
+		}
 		if !ok {
 			err = fmt.Errorf("invalid frames")
 			c.feedError(err)
@@ -62,11 +92,14 @@ func (c *readConn) feedframes(r io.ReadCloser) (datalen int, err error) {
 		if f.idx == 0 {
 			break
 		}
-		if c.closed {
-			return 0, errClosedConn
+		if err := c.failure(); err != nil {
+			return 0, err
 		}
-		if c.err != nil {
-			return 0, c.err
+		if f.options&optAck != 0 {
+			if len(f.data) == 4 && c.onAck != nil {
+				c.onAck(binary.BigEndian.Uint32(f.data))
+			}
+			continue
 		}
 
 		// v.Vprint("feed: ", f.data)
@@ -74,11 +107,20 @@ func (c *readConn) feedframes(r io.ReadCloser) (datalen int, err error) {
 		if !c.feedframe(f) {
 			return 0, errClosedConn
 		}
+		countFrame(false, len(f.data))
 		count += len(f.data)
 	}
 	return count, nil
 }
 
+// acked returns idx of the last frame moved to the read buffer, which is sent back as the ack,
+// so the other side stops sending when the reader falls behind
+func (c *readConn) acked() uint32 {
+	c.Lock()
+	defer c.Unlock()
+	return c.counter
+}
+
 func (c *readConn) feedframe(f frame) (ok bool) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -95,11 +137,35 @@ func (c *readConn) feedframe(f frame) (ok bool) {
 }
 
 func (c *readConn) feedError(err error) {
+	c.Lock()
+	if err != errClosedConn && c.err == nil && !c.closed {
+		atomic.AddInt64(&counters.Errors, 1)
+	}
 	c.err = err
+	c.Unlock()
 	c.ready.Touch(dummyTouch)
 	c.close()
 }
 
+// failure returns the error which broke the conn, errClosedConn if it is closed, or nil
+func (c *readConn) failure() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if c.closed {
+		return errClosedConn
+	}
+	return nil
+}
+
+func (c *readConn) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
 func (c *readConn) close() {
 	c.Lock()
 	defer c.Unlock()
@@ -107,6 +173,11 @@ func (c *readConn) close() {
 		return
 	}
 	c.closed = true
+	if c.tag == 'c' {
+		atomic.AddInt64(&counters.ClientConns, -1)
+	} else {
+		atomic.AddInt64(&counters.ServerConns, -1)
+	}
 	close(c.frames)
 	c.ready.SetWaitDeadline(time.Now())
 }
@@ -128,48 +199,21 @@ LOOP:
 			return
 		}
 
-		if f.idx <= c.counter {
+		if _, dup := c.futureframes[f.idx]; dup || f.idx <= c.counter {
+			// Resent by the other side because it didn't see our response
 			c.Unlock()
-			//c.feedError(fmt.Errorf("unmatched counter, maybe server GCed the connection"))
-			return
+			goto LOOP
+		}
+
+		if c.futureSize+len(f.data) > MaxReadBufferSize && f.idx != c.counter+1 {
+			c.Unlock()
+			atomic.AddInt64(&counters.DroppedFrames, 1)
+			goto LOOP
 		}
 
 		c.futureframes[f.idx] = f
 		c.futureSize += len(f.data)
-		for {
-			idx := c.counter + 1
-			if f, ok := c.futureframes[idx]; ok {
-				if f.future {
-					buf, err := ioutil.ReadFile(frameTmpPath(c.idx, f.idx))
-					if err != nil {
-						c.Unlock()
-						c.feedError(fmt.Errorf("fatal: missing certain frame from disk"))
-						return
-					}
-					os.Remove(frameTmpPath(c.idx, f.idx))
-					f.data = buf
-					v.Vprint(c, " back load frame: ", f)
-				}
-
-				c.buf = append(c.buf, f.data...)
-				c.counter = f.idx
-				delete(c.futureframes, f.idx)
-				c.futureSize -= len(f.data)
-				continue
-			}
-
-			if c.futureSize > MaxReadBufferSize {
-				if ioutil.WriteFile(frameTmpPath(c.idx, f.idx), f.data, 0755) != nil {
-					c.Unlock()
-					c.feedError(fmt.Errorf("fatal: missing certain frame"))
-					return
-				}
-
-				v.Vprint(c, " tmp save frame: ", f)
-				c.futureframes[f.idx] = frame{future: true, idx: f.idx}
-			}
-			break
-		}
+		c.rearrange()
 		if c.counter == 0xffffffff {
 			panic("surprise!")
 		}
@@ -179,14 +223,26 @@ LOOP:
 	goto LOOP
 }
 
-func (c *readConn) Read(p []byte) (n int, err error) {
-READ:
-	if c.closed {
-		return 0, errClosedConn
+// rearrange moves frames in order to the read buffer until it is full, c must be locked
+func (c *readConn) rearrange() {
+	for len(c.buf) < MaxReadBufferSize {
+		f, ok := c.futureframes[c.counter+1]
+		if !ok {
+			return
+		}
+		c.buf = append(c.buf, f.data...)
+		c.eof = c.eof || f.options&optFIN != 0
+		c.counter = f.idx
+		delete(c.futureframes, f.idx)
+		c.futureSize -= len(f.data)
 	}
+}
 
-	if c.err != nil {
-		return 0, c.err
+func (c *readConn) Read(p []byte) (n int, err error) {
+READ:
+	// The error which broke the connection is returned rather than errClosedConn
+	if err := c.failure(); err != nil {
+		return 0, err
 	}
 
 	if c.ready.IsTimedout() {
@@ -197,15 +253,20 @@ READ:
 	if len(c.buf) > 0 {
 		n = copy(p, c.buf)
 		c.buf = c.buf[n:]
+		c.rearrange()
 		c.Unlock()
 		return
 	}
+	if c.eof {
+		c.Unlock()
+		return 0, io.EOF
+	}
 	c.Unlock()
 
 	_, ontime := c.ready.Wait()
 
-	if c.closed {
-		return 0, errClosedConn
+	if c.failure() != nil {
+		goto READ
 	}
 
 	if !ontime {
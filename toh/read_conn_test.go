@@ -0,0 +1,82 @@
+package toh
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadConnBounded(t *testing.T) {
+	defer func(n int) { MaxReadBufferSize = n }(MaxReadBufferSize)
+	MaxReadBufferSize = 10
+
+	c := newReadConn(1, nil, 'c')
+	defer c.close()
+
+	data := func(idx uint32) []byte { return bytes.Repeat([]byte{byte(idx)}, 4) }
+	dropped := atomic.LoadInt64(&counters.DroppedFrames)
+	for idx := uint32(1); idx <= 6; idx++ {
+		c.feedframe(frame{connIdx: 1, idx: idx, data: data(idx)})
+	}
+
+	// 1-3 fill the buffer, 4 and 5 wait, 6 is dropped and not acked
+	for start := time.Now(); atomic.LoadInt64(&counters.DroppedFrames) == dropped; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("frame is not dropped")
+		}
+	}
+	if c.acked() != 3 {
+		t.Fatal(c.acked())
+	}
+
+	p := make([]byte, 12)
+	if n, err := io.ReadFull(c, p); n != 12 || err != nil || !bytes.Equal(p[8:], data(3)) {
+		t.Fatal(n, err, p)
+	}
+	if c.acked() != 5 {
+		t.Fatal(c.acked())
+	}
+
+	// resent by the other side
+	c.feedframe(frame{connIdx: 1, idx: 6, data: data(6)})
+	if n, err := io.ReadFull(c, p); n != 12 || err != nil || !bytes.Equal(p[:4], data(4)) || !bytes.Equal(p[8:], data(6)) {
+		t.Fatal(n, err, p)
+	}
+	if c.acked() != 6 {
+		t.Fatal(c.acked())
+	}
+}
+
+func TestReadConnFrames(t *testing.T) {
+	c := newReadConn(1, nil, 'c')
+	defer c.close()
+
+	for _, f := range []frame{
+		{connIdx: 1, idx: 2, data: []byte("c")},
+		{connIdx: 1, idx: 1, data: []byte("ab")},
+		{connIdx: 1, idx: 2, data: []byte("x")}, // duplicated
+		{connIdx: 1, idx: 1, data: []byte("y")}, // already acked
+		{connIdx: 1, idx: 4, options: optFIN},
+		{connIdx: 1, idx: 3, data: []byte("d")},
+	} {
+		c.feedframe(f)
+	}
+
+	c.ready.SetWaitDeadline(time.Now().Add(time.Second))
+	buf, err := ioutil.ReadAll(c)
+	if err != nil || string(buf) != "abcd" || c.acked() != 4 {
+		t.Fatal(string(buf), err, c.acked())
+	}
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatal(n, err)
+	}
+
+	// the resent FIN is dropped as well
+	c.feedframe(frame{connIdx: 1, idx: 4, options: optFIN, data: []byte("z")})
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatal(n, err)
+	}
+}
@@ -2,14 +2,13 @@ package toh
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"net/http"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/coyove/common/sched"
@@ -26,20 +25,21 @@ type ServerConn struct {
 	idx        uint64
 	rev        *Listener
 	schedPurge sched.SchedKey
+	opts       CommonOptions
+	user       string
+	remote     net.Addr
 
-	write struct {
-		sync.Mutex
-		buf     []byte
-		counter uint32
-	}
-
-	read *readConn
+	write writeBuf
+	read  *readConn
 }
 
-func newServerConn(idx uint64, ln *Listener) *ServerConn {
+func newServerConn(idx uint64, ln *Listener, blk cipher.Block) *ServerConn {
 	c := &ServerConn{idx: idx}
 	c.rev = ln
-	c.read = newReadConn(c.idx, ln.blk, 's')
+	c.opts = ln.CommonOptions
+	c.write.init()
+	c.read = newReadConn(c.idx, blk, 's')
+	c.read.onAck = c.write.ack
 	return c
 }
 
@@ -48,8 +48,12 @@ func (l *Listener) randomReply(w http.ResponseWriter, r *http.Request) {
 
 	r.Header.Del("Content-Length")
 
-	if l.OnBadRequest != nil {
-		l.OnBadRequest(w, r)
+	l.connsmu.Lock()
+	onBadRequest := l.OnBadRequest
+	l.connsmu.Unlock()
+
+	if onBadRequest != nil {
+		onBadRequest(w, r)
 		return
 	}
 
@@ -63,19 +67,20 @@ func (l *Listener) randomReply(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
-	if strings.ToLower(r.Header.Get("Sec-WebSocket-Key")) != "" {
-		conn, err := l.wsHandShake(w, r)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			v.Eprint("websocket handshake error: ", err)
-		} else {
-			l.pendingConns <- conn
-		}
+func (l *Listener) serveFrames(w http.ResponseWriter, r *http.Request) {
+	var header [20]byte
+	n, _ := io.ReadFull(r.Body, header[:])
+	// Put the header back so bad requests can still be passed to OnBadRequest as they are
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(header[:n]), r.Body), r.Body}
+
+	key, ok := l.matchKey(header)
+	if n != len(header) || !ok {
+		l.randomReply(w, r)
 		return
 	}
+	blk := key.blk
 
-	hdr, ok := parseframe(r.Body, l.blk)
+	hdr, ok := parseframe(r.Body, blk)
 	if !ok {
 		l.randomReply(w, r)
 		return
@@ -87,9 +92,9 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 		l.connsmu.Lock()
 		c := l.conns[hdr.connIdx]
 		l.connsmu.Unlock()
-		if c != nil {
+		if c != nil && key.owns(c) {
 			v.Vprint(c, " received close ping, client side has closed")
-			c.Close()
+			c.close()
 		}
 	case optPing:
 		l.connsmu.Lock()
@@ -97,8 +102,8 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 		for i := 0; i < len(hdr.data); i += 8 {
 			connIdx := binary.BigEndian.Uint64(hdr.data[i : i+8])
 
-			if c := l.conns[connIdx]; c != nil && c.read.err == nil && !c.read.closed {
-				if len(c.write.buf) > 0 {
+			if c := l.conns[connIdx]; c != nil && key.owns(c) && c.read.failure() == nil {
+				if c.write.hasPending() {
 					binary.Write(&p, binary.BigEndian, PING_OK)
 				} else {
 					binary.Write(&p, binary.BigEndian, PING_OK_VOID)
@@ -113,7 +118,7 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 		l.connsmu.Unlock()
 
 		f := frame{options: optPing, data: p.Bytes()}
-		w.Write(f.marshal(l.blk))
+		w.Write(f.marshal(blk))
 		return
 	default:
 		l.randomReply(w, r)
@@ -126,24 +131,46 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 	if sc, _ := l.conns[connIdx]; sc != nil {
 		conn = sc
 		l.connsmu.Unlock()
+		if !key.owns(conn) {
+			// Keys of other users can't touch the connection
+			l.randomReply(w, r)
+			return
+		}
 	} else {
 		// New incoming connection?
-		f, ok := parseframe(r.Body, l.blk)
-		if !ok || f.options&optHello == 0 || f.connIdx != connIdx {
-			if !ok {
-				l.randomReply(w, r)
+		// New connections must use the current key, old keys are only valid for existing ones
+		f, ok := parseframe(r.Body, blk)
+		if !ok || !key.current || f.options&optHello == 0 || f.connIdx != connIdx {
+			l.connsmu.Unlock()
+			if ok && f.options&optHello == 0 {
+				// The conn has been closed or purged, or the server has restarted
+				http.Error(w, errGone.Error(), http.StatusGone)
 			} else {
-				// TODO: tell client the conn has gone
+				l.randomReply(w, r)
 			}
-			l.connsmu.Unlock()
 			return
 		}
 
-		conn = newServerConn(connIdx, l)
-		l.conns[connIdx] = conn
+		conn = newServerConn(connIdx, l, blk)
+		conn.user = key.user
+		addr := l.remoteAddr(r)
+		conn.remote = addr
+		tc, err := l.admit(conn, addr.IP.String(), key.user, true)
+		if err == nil {
+			l.conns[connIdx] = conn
+		}
 		l.connsmu.Unlock()
 
-		l.pendingConns <- conn
+		if err == nil {
+			err = l.deliver(tc)
+		} else {
+			conn.Close()
+		}
+		if err != nil {
+			v.Vprint("reject new conn: ", conn, ", ", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		v.Vprint("accpet new conn: ", conn)
 		conn.reschedDeath()
 		//conn.writeTo(w)
@@ -154,7 +181,7 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 		v.Eprint("listener feed frames, error: ", err, ", ", conn, " will be deleted")
 		conn.Close()
 		return
-	} else if datalen == 0 && len(conn.write.buf) == 0 {
+	} else if datalen == 0 && !conn.write.hasPending() {
 		// Client sent nothing, we treat the request as a ping
 		// However too many pings without:
 		//   1) sending any valid data to us
@@ -171,16 +198,26 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 func (conn *ServerConn) reschedDeath() {
 	conn.schedPurge.Reschedule(func() {
 		v.VVVprint(conn, " will die as scheduled")
-		conn.Close()
-	}, conn.rev.Timeout)
+		conn.close()
+	}, conn.opts.Timeout)
 }
 
 func (conn *ServerConn) writeTo(w io.Writer) {
 
+	// Tell the client what we have received at last, so it can drop or resend its frames
+	defer func() {
+		w.Write(ackFrame(conn.idx, conn.read.acked()).marshal(conn.read.blk))
+	}()
+
 	for i := 0; ; i++ {
 		conn.write.Lock()
-		if len(conn.write.buf) == 0 {
-			conn.write.Unlock()
+		frames := conn.write.due()
+		if f := conn.write.next(conn.idx); f != nil {
+			frames = append(frames, f)
+		}
+		conn.write.Unlock()
+
+		if len(frames) == 0 {
 			if i == 0 {
 				time.Sleep(200 * time.Millisecond)
 				continue
@@ -188,27 +225,14 @@ func (conn *ServerConn) writeTo(w io.Writer) {
 			return
 		}
 
-		f := &frame{
-			idx:     conn.write.counter + 1,
-			connIdx: conn.idx,
-			data:    make([]byte, len(conn.write.buf)),
-		}
-
-		copy(f.data, conn.write.buf)
-		conn.write.buf = conn.write.buf[:0]
-		conn.write.counter++
-		conn.write.Unlock()
-
-		deadline := time.Now().Add(conn.rev.Timeout - time.Second)
-	AGAIN:
-		if _, err := w.Write(f.marshal(conn.read.blk)); err != nil {
-			if time.Now().Before(deadline) {
-				goto AGAIN
+		for _, f := range frames {
+			if _, err := w.Write(f.marshal(conn.read.blk)); err != nil {
+				// Frames are kept until acknowledged, the client will poll again
+				v.Vprint(conn, " failed to response, error: ", err)
+				conn.write.unsent(frames)
+				return
 			}
-			v.Eprint(conn, " failed to response, error: ", err)
-			conn.read.feedError(err)
-			conn.Close()
-			return
+			countFrame(true, len(f.data))
 		}
 	}
 }
@@ -220,47 +244,81 @@ func (c *ServerConn) SetReadDeadline(t time.Time) error {
 
 func (c *ServerConn) SetDeadline(t time.Time) error {
 	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
 	return nil
 }
 
 func (c *ServerConn) SetWriteDeadline(t time.Time) error {
+	c.write.setDeadline(t)
 	return nil
 }
 
 func (c *ServerConn) Write(p []byte) (n int, err error) {
-REWRITE:
-	if c.read.closed {
-		return 0, errClosedConn
+	if err := c.write.wait(c.opts.MaxWriteBuffer, c.writeErr); err != nil {
+		return 0, err
 	}
 
-	if c.read.err != nil {
-		return 0, c.read.err
+	c.write.Lock()
+	defer c.write.Unlock()
+	if c.write.closed() {
+		return 0, errClosedConn
 	}
-
-	if len(c.write.buf) > c.rev.MaxWriteBuffer {
-		v.Vprint(c, " write buffer is full")
-		time.Sleep(time.Second)
-		goto REWRITE
+	if c.write.shut {
+		return 0, errShutdown
 	}
+	c.write.append(p)
+	return len(p), nil
+}
 
+// CloseWrite sends FIN to the client after buffered data, the client will read io.EOF
+func (c *ServerConn) CloseWrite() error {
 	c.write.Lock()
-	c.write.buf = append(c.write.buf, p...)
+	c.write.shut = true
 	c.write.Unlock()
-	return len(p), nil
+	return c.writeErr()
+}
+
+func (c *ServerConn) writeErr() error {
+	return c.read.failure()
 }
 
 func (c *ServerConn) Read(p []byte) (n int, err error) {
+	if c.write.closed() {
+		return 0, errClosedConn
+	}
 	return c.read.Read(p)
 }
 
+// Close closes the connection without blocking, like TCP, data and FIN are still delivered
+// in background if CloseWrite has been called
 func (c *ServerConn) Close() error {
-	if c.read.closed {
+	first, linger := c.write.close()
+	if !first {
+		return nil
+	}
+	if !linger {
+		return c.close()
+	}
+	go func() {
+		c.write.drain(c.opts.Timeout, c.writeErr)
+		c.close()
+	}()
+	return nil
+}
+
+func (c *ServerConn) close() error {
+	if c.read.isClosed() {
 		return nil
 	}
 
 	v.VVprint(c, " closing")
 	c.schedPurge.Cancel()
 	c.read.close()
+
+	c.write.Lock()
+	c.write.reset()
+	c.write.Unlock()
+
 	c.rev.connsmu.Lock()
 	delete(c.rev.conns, c.idx)
 	c.rev.connsmu.Unlock()
@@ -268,8 +326,26 @@ func (c *ServerConn) Close() error {
 	return nil
 }
 
+// ID returns the connection index shared with the client
+func (c *ServerConn) ID() string {
+	return formatConnIdx(c.idx)
+}
+
+// User returns the user whose key was used to establish the connection, empty for the default key
+func (c *ServerConn) User() string {
+	return c.user
+}
+
+// Buffered returns the number of bytes not received by the client yet
+func (c *ServerConn) Buffered() int {
+	c.write.Lock()
+	defer c.write.Unlock()
+	c.write.dropAcked()
+	return len(c.write.buf) + c.write.unackedSize
+}
+
 func (c *ServerConn) RemoteAddr() net.Addr {
-	return &net.TCPAddr{}
+	return c.remote
 }
 
 func (c *ServerConn) LocalAddr() net.Addr {
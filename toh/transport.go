@@ -0,0 +1,240 @@
+package toh
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/goflyway/v"
+)
+
+const (
+	TransportHTTP      = "http"
+	TransportWebSocket = "websocket"
+)
+
+// Transport carries toh connections between a Dialer and a Listener.
+// A transport must be registered on both sides under the same name.
+type Transport interface {
+	// Dial establishes a new connection to the Listener at d.Endpoint()
+	Dial(d *Dialer) (net.Conn, error)
+
+	// Match reports whether the incoming request belongs to this transport
+	Match(r *http.Request) bool
+
+	// Serve handles the matched request, newly established connections
+	// should be passed to ln.Deliver so they can be returned by ln.Accept
+	Serve(ln *Listener, w http.ResponseWriter, r *http.Request)
+}
+
+type namedTransport struct {
+	name string
+	Transport
+}
+
+var (
+	transports   []namedTransport
+	transportsmu sync.RWMutex
+)
+
+func init() {
+	RegisterTransport(TransportHTTP, httpTransport{})
+	RegisterTransport(TransportWebSocket, wsTransport{})
+}
+
+// RegisterTransport registers a transport under name, replacing the previous one if any.
+// When serving, transports registered later are matched first
+func RegisterTransport(name string, t Transport) {
+	transportsmu.Lock()
+	defer transportsmu.Unlock()
+
+	name = strings.ToLower(name)
+	for i, nt := range transports {
+		if nt.name == name {
+			transports[i].Transport = t
+			return
+		}
+	}
+	transports = append(transports, namedTransport{name: name, Transport: t})
+}
+
+func LookupTransport(name string) Transport {
+	transportsmu.RLock()
+	defer transportsmu.RUnlock()
+
+	name = strings.ToLower(name)
+	for _, nt := range transports {
+		if nt.name == name {
+			return nt.Transport
+		}
+	}
+	return nil
+}
+
+func matchTransport(r *http.Request) Transport {
+	transportsmu.RLock()
+	defer transportsmu.RUnlock()
+
+	for i := len(transports) - 1; i >= 0; i-- {
+		if transports[i].Match(r) {
+			return transports[i].Transport
+		}
+	}
+	return nil
+}
+
+func (d *Dialer) Dial() (net.Conn, error) {
+	t := LookupTransport(d.protocol())
+	if t == nil {
+		return nil, fmt.Errorf("unknown transport: %s", d.protocol())
+	}
+	start := time.Now()
+	conn, err := t.Dial(d)
+	if err == nil {
+		countDial(time.Since(start))
+	}
+	return conn, err
+}
+
+// protocol returns the transport to dial, the deprecated WebSocket field is still honoured
+func (d *Dialer) protocol() string {
+	if d.WebSocket && (d.Protocol == "" || d.Protocol == TransportHTTP) {
+		return TransportWebSocket
+	}
+	return d.Protocol
+}
+
+func (d *Dialer) Endpoint() string {
+	return d.endpoint
+}
+
+func (d *Dialer) Cipher() cipher.Block {
+	return d.blk
+}
+
+// Cipher returns the cipher of the current default key
+func (l *Listener) Cipher() cipher.Block {
+	l.keysmu.RLock()
+	defer l.keysmu.RUnlock()
+	for _, k := range l.keys {
+		if k.current && k.user == "" {
+			return k.blk
+		}
+	}
+	return nil
+}
+
+// Deliver passes conn to Accept if it is admitted by the limits, otherwise conn is closed
+func (l *Listener) Deliver(conn net.Conn) error {
+	ip := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	l.connsmu.Lock()
+	tc, err := l.admit(conn, ip, "", false)
+	l.connsmu.Unlock()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return l.deliver(tc)
+}
+
+// Admit counts conn from ip of user as an active connection if the limits allow,
+// the returned conn must be closed to release it. Unlike Deliver, it is not passed to Accept
+func (l *Listener) Admit(conn net.Conn, ip, user string) (net.Conn, error) {
+	l.connsmu.Lock()
+	defer l.connsmu.Unlock()
+	tc, err := l.admit(conn, ip, user, true)
+	if err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// deliver passes the admitted conn to Accept without waiting
+func (l *Listener) deliver(tc *trackedConn) error {
+	select {
+	case l.pendingConns <- tc:
+		return nil
+	default:
+		tc.Close()
+		return fmt.Errorf("too many connections waiting to be accepted")
+	}
+}
+
+// remoteAddr returns the address of the client who sent r, if r comes from trusted proxies,
+// the rightmost untrusted address in X-Forwarded-For is used. connsmu must be held
+func (l *Listener) remoteAddr(r *http.Request) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0 && l.trusted(addr.IP); i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		addr = &net.TCPAddr{IP: ip}
+	}
+	return addr
+}
+
+func (l *Listener) trusted(ip net.IP) bool {
+	for _, n := range l.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
+	if t := matchTransport(r); t != nil {
+		t.Serve(l, w, r)
+		return
+	}
+	l.randomReply(w, r)
+}
+
+type httpTransport struct{}
+
+func (httpTransport) Dial(d *Dialer) (net.Conn, error) {
+	return d.newClientConn()
+}
+
+func (httpTransport) Match(r *http.Request) bool {
+	return true
+}
+
+func (httpTransport) Serve(ln *Listener, w http.ResponseWriter, r *http.Request) {
+	ln.serveFrames(w, r)
+}
+
+type wsTransport struct{}
+
+func (wsTransport) Dial(d *Dialer) (net.Conn, error) {
+	return d.wsHandshake()
+}
+
+func (wsTransport) Match(r *http.Request) bool {
+	return r.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+func (wsTransport) Serve(ln *Listener, w http.ResponseWriter, r *http.Request) {
+	conn, err := ln.wsHandShake(w, r)
+	if err != nil {
+		v.Eprint("websocket handshake error: ", err)
+		return
+	}
+	if err := ln.deliver(conn); err != nil {
+		v.Vprint("reject new websocket conn: ", err)
+	}
+}
@@ -0,0 +1,77 @@
+package toh
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+)
+
+type fakeTransport struct{ name string }
+
+func (t fakeTransport) Dial(d *Dialer) (net.Conn, error) {
+	return nil, errors.New(t.name)
+}
+
+func (fakeTransport) Match(r *http.Request) bool {
+	return r.Header.Get("X-Fake") != ""
+}
+
+func (fakeTransport) Serve(ln *Listener, w http.ResponseWriter, r *http.Request) {}
+
+func TestRegisterTransport(t *testing.T) {
+	RegisterTransport("Fake", fakeTransport{"a"})
+	RegisterTransport("fake", fakeTransport{"b"})
+
+	if tr, ok := LookupTransport("FAKE").(fakeTransport); !ok || tr.name != "b" {
+		t.Fatal(tr)
+	}
+	if LookupTransport("nope") != nil {
+		t.Fatal("unexpected transport")
+	}
+
+	r, _ := http.NewRequest("POST", "/", nil)
+	if _, ok := matchTransport(r).(httpTransport); !ok {
+		t.Fatal(matchTransport(r))
+	}
+	r.Header.Set("Sec-WebSocket-Key", "x")
+	if _, ok := matchTransport(r).(wsTransport); !ok {
+		t.Fatal(matchTransport(r))
+	}
+	r.Header.Set("X-Fake", "1")
+	if _, ok := matchTransport(r).(fakeTransport); !ok {
+		t.Fatal(matchTransport(r))
+	}
+
+	if _, err := NewDialer("k", "127.0.0.1:1", WithProtocol("fake")).Dial(); err == nil || err.Error() != "b" {
+		t.Fatal(err)
+	}
+	if _, err := NewDialer("k", "127.0.0.1:1", WithProtocol("nope")).Dial(); err == nil {
+		t.Fatal("dialed an unknown transport")
+	}
+}
+
+func TestDialerProtocol(t *testing.T) {
+	for i, c := range []struct {
+		options  []Option
+		protocol string
+	}{
+		{nil, TransportHTTP},
+		{[]Option{WithWebSocket(true)}, TransportWebSocket},
+		{[]Option{WithWebSocket(true), WithWebSocket(false)}, TransportHTTP},
+		{[]Option{WithWebSocket(true), WithProtocol("fake")}, "fake"},
+		{[]Option{WithProtocol("fake"), WithWebSocket(false)}, "fake"},
+		{[]Option{WithProtocol(TransportWebSocket), WithWebSocket(false)}, TransportHTTP},
+	} {
+		if p := NewDialer("k", "127.0.0.1:1", c.options...).protocol(); p != c.protocol {
+			t.Fatal(i, p)
+		}
+	}
+
+	// The deprecated field still works when set after NewDialer
+	d := NewDialer("k", "127.0.0.1:1")
+	d.WebSocket = true
+	if p := d.protocol(); p != TransportWebSocket {
+		t.Fatal(p)
+	}
+}
@@ -4,10 +4,9 @@ import (
 	"bufio"
 	"encoding/base32"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
-	"os"
-	"path/filepath"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -31,6 +30,11 @@ func (e *timeoutError) Temporary() bool {
 	return false
 }
 
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 type BufConn struct {
 	net.Conn
 	*bufio.Reader
@@ -48,6 +52,18 @@ func (c *BufConn) Read(p []byte) (int, error) {
 	return c.Reader.Read(p)
 }
 
+func (c *BufConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// CloseWrite half-closes conn, it fails if conn doesn't support it
+func CloseWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return fmt.Errorf("%T doesn't support CloseWrite", conn)
+}
+
 var countermark uint32
 
 func newConnectionIdx() uint64 {
@@ -60,7 +76,3 @@ func newConnectionIdx() uint64 {
 func formatConnIdx(idx uint64) string {
 	return base32.HexEncoding.EncodeToString((*(*[8]byte)(unsafe.Pointer(&idx)))[1:6])
 }
-
-func frameTmpPath(connIdx uint64, idx uint32) string {
-	return filepath.Join(os.TempDir(), fmt.Sprintf("%x-%d.toh", connIdx, idx))
-}
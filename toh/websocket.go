@@ -12,33 +12,96 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 type WSConn struct {
 	net.Conn
 	mu   sync.Mutex
-	blk  cipher.Block
+	wmu  sync.Mutex   // frames of concurrent writes must not interleave
+	blk  atomic.Value // cipher.Block, set by the first Read on the server side
 	mask bool
 	buf  []byte
+
+	keys   []listenerKey // server side, the first payload decides which key is used
+	user   atomic.Value  // string
+	onKey  func(user string) error
+	remote net.Addr
+	shut   bool // protected by wmu
+	eof    bool // protected by mu
+}
+
+// User returns the user whose key was used by the client, empty for the default key
+func (c *WSConn) User() string {
+	u, _ := c.user.Load().(string)
+	return u
+}
+
+// RemoteAddr returns the client address, which differs from the TCP peer if the conn comes through trusted proxies
+func (c *WSConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *WSConn) block() cipher.Block {
+	blk, _ := c.blk.Load().(cipher.Block)
+	return blk
 }
 
 func (c *WSConn) Write(p []byte) (int, error) {
 	L := len(p)
+	if c.block() == nil {
+		return 0, fmt.Errorf("websocket key is unknown until the client has sent something")
+	}
+	if L == 0 {
+		// an empty payload means FIN
+		return 0, nil
+	}
+	if err := c.writePayload(p); err != nil {
+		return 0, err
+	}
+	return L, nil
+}
+
+// CloseWrite sends an empty payload, the other side will read io.EOF
+func (c *WSConn) CloseWrite() error {
+	if c.block() == nil {
+		return fmt.Errorf("websocket key is unknown until the client has sent something")
+	}
+	return c.writePayload(nil)
+}
+
+func (c *WSConn) writePayload(p []byte) error {
+	L := len(p)
 
 	// TODO
 	key := make([]byte, 12)
 	rand.Read(key)
 
-	gcm, _ := cipher.NewGCM(c.blk)
+	gcm, _ := cipher.NewGCM(c.block())
 
-	p = gcm.Seal(p[:0], key, p, nil)
-	p = append(p, key...)
+	// p belongs to the caller, seal it into a new buffer
+	buf := gcm.Seal(make([]byte, 0, L+gcm.Overhead()+len(key)), key, p, nil)
+	buf = append(buf, key...)
 
-	if _, err := wsWrite(c.Conn, p, c.mask); err != nil {
-		return 0, err
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.shut {
+		return errShutdown
 	}
-	return L, nil
+	c.shut = L == 0
+
+	// Write deadlines are handled by the underlying conn, its timeout error is a net.Error
+	if _, err := wsWrite(c.Conn, buf, c.mask); err != nil {
+		return err
+	}
+	countFrame(true, L)
+	return nil
 }
 
 func (c *WSConn) Read(p []byte) (int, error) {
@@ -51,6 +114,9 @@ READ:
 		c.buf = c.buf[n:]
 		return n, nil
 	}
+	if c.eof {
+		return 0, io.EOF
+	}
 
 	payload, _, err := wsRead(c.Conn)
 	if err != nil {
@@ -63,14 +129,37 @@ READ:
 	key := payload[len(payload)-12:]
 	payload = payload[:len(payload)-12]
 
-	gcm, _ := cipher.NewGCM(c.blk)
+	blk := c.block()
+	if blk == nil {
+		for _, k := range c.keys {
+			gcm, _ := cipher.NewGCM(k.blk)
+			if _, err := gcm.Open(nil, key, payload, nil); err == nil {
+				if c.onKey != nil {
+					if err := c.onKey(k.user); err != nil {
+						return 0, err
+					}
+				}
+				blk, c.keys = k.blk, nil
+				c.user.Store(k.user)
+				c.blk.Store(blk)
+				break
+			}
+		}
+		if blk == nil {
+			return 0, fmt.Errorf("invalid websocket payload: unknown key")
+		}
+	}
+
+	gcm, _ := cipher.NewGCM(blk)
 
 	payload, err = gcm.Open(payload[:0], key, payload, nil)
 	if err != nil {
 		return 0, err
 	}
 
+	countFrame(false, len(payload))
 	c.buf = payload
+	c.eof = len(payload) == 0
 	goto READ
 }
 
@@ -111,8 +200,8 @@ REDIR:
 	c := &WSConn{
 		Conn: NewBufConn(conn),
 		mask: true,
-		blk:  d.blk,
 	}
+	c.blk.Store(d.blk)
 
 	resp, err := http.ReadResponse(c.Conn.(*BufConn).Reader, nil)
 	if err != nil {
@@ -145,22 +234,38 @@ REDIR:
 	return c, nil
 }
 
-func (ln *Listener) wsHandShake(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+func (ln *Listener) wsHandShake(w http.ResponseWriter, r *http.Request) (*trackedConn, error) {
 	ans := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		return nil, err
 	}
 
+	ws := &WSConn{Conn: conn, keys: ln.currentKeys()}
+	ln.connsmu.Lock()
+	addr := ln.remoteAddr(r)
+	ws.remote = addr
+	tc, err := ln.admit(ws, addr.IP.String(), "", false)
+	ln.connsmu.Unlock()
+	if err != nil {
+		msg := err.Error()
+		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n" +
+			"Connection: close\r\n" +
+			"Content-Length: " + strconv.Itoa(len(msg)) + "\r\n\r\n" + msg))
+		conn.Close()
+		return nil, err
+	}
+	ws.onKey = tc.claimUser
+
 	if _, err := conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
 		"Upgrade: websocket\r\n" +
 		"Connection: upgrade\r\n" +
 		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(ans[:]) + "\r\n\r\n")); err != nil {
-		conn.Close()
+		tc.Close()
 		return nil, err
 	}
-
-	return &WSConn{Conn: conn, blk: ln.blk}, nil
+	return tc, nil
 }
 
 // WSWrite and WSRead are simple implementations of RFC6455
@@ -0,0 +1,237 @@
+package goflyway
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/coyove/goflyway/toh"
+	"github.com/coyove/goflyway/v"
+)
+
+const (
+	BalanceRoundRobin = "roundrobin"
+	BalanceLeastConn  = "leastconn"
+	BalanceLatency    = "latency"
+)
+
+// Upstream describes a goflyway server, empty Key and Protocol fall back to the ones in ClientConfig,
+// an empty Protocol with WebSocket set means websocket
+type Upstream struct {
+	Addr      string `json:"addr"`
+	Key       string `json:"key"`
+	WebSocket bool   `json:"websocket"`
+	Protocol  string `json:"protocol"`
+}
+
+type upstream struct {
+	Upstream
+	dialer  *toh.Dialer
+	active  int64 // number of active connections
+	latency int64 // smoothed round trip time in nanoseconds
+	down    int32 // 1 if the upstream failed recently
+}
+
+type upstreamPool struct {
+	ups     []*upstream
+	balance string
+	rr      uint64
+	done    chan bool
+}
+
+func newUpstreamPool(config *ClientConfig, tr http.RoundTripper) *upstreamPool {
+	p := &upstreamPool{balance: config.Balance, done: make(chan bool)}
+
+	ups := config.Upstreams
+	if len(ups) == 0 {
+		ups = []Upstream{{Addr: config.Upstream, WebSocket: config.WebSocket}}
+	}
+
+	for _, u := range ups {
+		if u.Key == "" {
+			u.Key = config.Key
+		}
+		u.Protocol = config.protocol(u)
+		p.ups = append(p.ups, &upstream{Upstream: u, dialer: config.newDialer(u, tr)})
+	}
+
+	if len(p.ups) > 1 {
+		go p.healthCheck(config.HealthCheck)
+	}
+	return p
+}
+
+// protocol resolves the transport of u, its own settings take precedence over the ones in ClientConfig
+func (config *ClientConfig) protocol(u Upstream) string {
+	switch {
+	case u.Protocol != "":
+		return u.Protocol
+	case u.WebSocket:
+		return toh.TransportWebSocket
+	case config.Protocol != "":
+		return config.Protocol
+	case config.WebSocket:
+		return toh.TransportWebSocket
+	}
+	return toh.TransportHTTP
+}
+
+func (config *ClientConfig) newDialer(u Upstream, tr http.RoundTripper) *toh.Dialer {
+	options := []toh.Option{
+		toh.WithProtocol(u.Protocol),
+		toh.WithInactiveTimeout(config.Timeout),
+		toh.WithTransport(tr),
+		toh.WithMaxWriteBuffer(int(config.WriteBuffer)),
+		toh.WithHeader(config.URLHeader),
+		toh.WithPathPattern(config.PathPattern),
+	}
+	if config.MaxIdleConns > 0 {
+		options = append(options, toh.WithMaxIdleConns(config.MaxIdleConns))
+	}
+	options = append(options,
+		toh.WithMaxActiveConns(config.MaxActiveConns),
+		toh.WithMaxInflight(config.MaxInflight),
+		toh.WithUploadWindow(config.UploadWindow))
+
+	return toh.NewDialer(u.Key, u.Addr, options...)
+}
+
+func (p *upstreamPool) healthCheck(interval time.Duration) {
+	if interval == 0 {
+		interval = time.Second * 10
+	}
+
+	for {
+		for _, u := range p.ups {
+			go func(u *upstream) {
+				rtt, err := u.dialer.Ping()
+				if err != nil {
+					if atomic.SwapInt32(&u.down, 1) == 0 {
+						v.Eprint("upstream ", u.Addr, " is down: ", err)
+					}
+					return
+				}
+
+				if atomic.SwapInt32(&u.down, 0) == 1 {
+					v.Vprint("upstream ", u.Addr, " is up, rtt: ", rtt.Nanoseconds()/1e6, "ms")
+				}
+				u.updateLatency(rtt)
+			}(u)
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// stop stops health checks and dialers, connections dialed from the pool are not affected
+func (p *upstreamPool) stop() {
+	close(p.done)
+	for _, u := range p.ups {
+		u.dialer.Close()
+	}
+}
+
+func (u *upstream) updateLatency(rtt time.Duration) {
+	if old := atomic.LoadInt64(&u.latency); old == 0 {
+		atomic.StoreInt64(&u.latency, int64(rtt))
+	} else {
+		atomic.StoreInt64(&u.latency, (old*7+int64(rtt))/8)
+	}
+}
+
+// candidates returns upstreams in the order they should be tried, healthy ones come first
+func (p *upstreamPool) candidates() []*upstream {
+	ups := make([]*upstream, len(p.ups))
+
+	start := int(atomic.AddUint64(&p.rr, 1) % uint64(len(p.ups)))
+	for i := range p.ups {
+		ups[i] = p.ups[(start+i)%len(p.ups)]
+	}
+
+	sort.SliceStable(ups, func(i, j int) bool {
+		a, b := ups[i], ups[j]
+		if da, db := atomic.LoadInt32(&a.down), atomic.LoadInt32(&b.down); da != db {
+			return da < db
+		}
+		switch p.balance {
+		case BalanceLeastConn:
+			return atomic.LoadInt64(&a.active) < atomic.LoadInt64(&b.active)
+		case BalanceLatency:
+			// Latency of upstreams not probed yet is unknown, they are tried last
+			la, lb := atomic.LoadInt64(&a.latency), atomic.LoadInt64(&b.latency)
+			if (la == 0) != (lb == 0) {
+				return lb == 0
+			}
+			return la < lb
+		}
+		return false
+	})
+	return ups
+}
+
+// Dial dials the best upstream and fails over to the next one if it failed
+func (p *upstreamPool) Dial() (net.Conn, error) {
+	var lastErr error
+
+	for _, u := range p.candidates() {
+		start := time.Now()
+		conn, err := u.dialer.Dial()
+		if err != nil {
+			if atomic.SwapInt32(&u.down, 1) == 0 && len(p.ups) > 1 {
+				v.Eprint("upstream ", u.Addr, " is down: ", err, ", failover")
+			}
+			lastErr = err
+			continue
+		}
+
+		atomic.StoreInt32(&u.down, 0)
+		u.updateLatency(time.Since(start))
+		atomic.AddInt64(&u.active, 1)
+		return &upstreamConn{Conn: conn, up: u}, nil
+	}
+
+	if len(p.ups) == 1 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("all upstreams failed, last error: %v", lastErr)
+}
+
+// DialAddr dials the upstream at addr, for connections which must reach a specific server
+func (p *upstreamPool) DialAddr(addr string) (net.Conn, error) {
+	for _, u := range p.ups {
+		if u.Addr != addr {
+			continue
+		}
+		conn, err := u.dialer.Dial()
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&u.active, 1)
+		return &upstreamConn{Conn: conn, up: u}, nil
+	}
+	return nil, fmt.Errorf("upstream %s not found", addr)
+}
+
+type upstreamConn struct {
+	net.Conn
+	up     *upstream
+	closed int32
+}
+
+func (c *upstreamConn) CloseWrite() error {
+	return toh.CloseWrite(c.Conn)
+}
+
+func (c *upstreamConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.up.active, -1)
+	}
+	return c.Conn.Close()
+}
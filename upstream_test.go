@@ -0,0 +1,130 @@
+package goflyway
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coyove/goflyway/toh"
+)
+
+func TestUpstreamCandidates(t *testing.T) {
+	for _, c := range []struct {
+		balance string
+		ups     []*upstream // a, b, c
+		first   string
+		last    string
+	}{
+		{BalanceLatency, []*upstream{{latency: 30}, {latency: 10}, {latency: 20}}, "b", "a"},
+		{BalanceLatency, []*upstream{{latency: 0}, {latency: 10}, {latency: 20}}, "b", "a"},
+		{BalanceLatency, []*upstream{{latency: 30}, {latency: 10, down: 1}, {latency: 20}}, "c", "b"},
+		{BalanceLeastConn, []*upstream{{active: 3}, {active: 1}, {active: 2}}, "b", "a"},
+		{BalanceLeastConn, []*upstream{{active: 3}, {active: 1, down: 1}, {active: 2}}, "c", "b"},
+		{BalanceRoundRobin, []*upstream{{}, {down: 1}, {down: 1}}, "a", ""},
+	} {
+		p := &upstreamPool{balance: c.balance, ups: c.ups}
+		for i, u := range p.ups {
+			u.Addr = string(rune('a' + i))
+		}
+		ups := p.candidates()
+		if ups[0].Addr != c.first || c.last != "" && ups[2].Addr != c.last {
+			t.Fatal(c.balance, ups[0].Addr, ups[1].Addr, ups[2].Addr)
+		}
+	}
+
+	// Round robin starts from the next upstream each time
+	p := &upstreamPool{ups: []*upstream{{Upstream: Upstream{Addr: "a"}}, {Upstream: Upstream{Addr: "b"}}}}
+	if a, b := p.candidates()[0].Addr, p.candidates()[0].Addr; a == b {
+		t.Fatal(a, b)
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	ln, err := toh.Listen("k", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	config := &ClientConfig{Upstreams: []Upstream{{Addr: "127.0.0.1:1"}, {Addr: ln.Addr().String()}}}
+	config.Key = "k"
+	config.check()
+	p := newUpstreamPool(config, nil)
+	defer p.stop()
+	atomic.StoreInt32(&p.ups[1].down, 1) // the good one looks down, so the bad one is tried first
+
+	conn, err := p.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if u := conn.(*upstreamConn).up; u != p.ups[1] || atomic.LoadInt64(&u.active) != 1 || atomic.LoadInt32(&u.down) != 0 {
+		t.Fatal(u)
+	}
+	if atomic.LoadInt32(&p.ups[0].down) != 1 {
+		t.Fatal("failed upstream is not marked down")
+	}
+}
+
+func TestUpstreamProtocol(t *testing.T) {
+	ln, err := toh.Listen("k", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan bool, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- true
+			conn.Close()
+		}
+	}()
+
+	config := &ClientConfig{Protocol: toh.TransportHTTP}
+	config.check()
+
+	addr := ln.Addr().String()
+	for _, c := range []struct {
+		u        Upstream
+		protocol string
+	}{
+		{Upstream{Key: "k", Addr: addr, WebSocket: true}, toh.TransportWebSocket},
+		{Upstream{Key: "k", Addr: addr}, toh.TransportHTTP},
+		{Upstream{Key: "k", Addr: addr, WebSocket: true, Protocol: toh.TransportHTTP}, toh.TransportHTTP},
+	} {
+		c.u.Protocol = config.protocol(c.u)
+		d := config.newDialer(c.u, nil)
+		if c.u.Protocol != c.protocol || d.Protocol != c.protocol {
+			t.Fatal(c.u, d.Protocol)
+		}
+
+		// the health check goes through the transport of the upstream
+		if _, err := d.Ping(); err != nil {
+			t.Fatal(c.u, err)
+		}
+		select {
+		case <-accepted:
+			if c.protocol != toh.TransportWebSocket {
+				t.Fatal(c.u, "ping frames should not create conns")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if c.protocol == toh.TransportWebSocket {
+				t.Fatal(c.u, "websocket upstream is not probed by dialing")
+			}
+		}
+	}
+}
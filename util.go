@@ -1,7 +1,11 @@
 package goflyway
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,12 +23,71 @@ func isTimeoutErr(err error) bool {
 	return false
 }
 
+// matchHost reports whether addr (host:port) matches pattern, which can be
+// "*", "host", "host:port", "*.domain" (domain and all its subdomains) or a CIDR
+func matchHost(pattern, addr string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		return host == pattern[2:] || strings.HasSuffix(host, pattern[1:])
+	case strings.Contains(pattern, "/"):
+		_, cidr, err := net.ParseCIDR(pattern)
+		ip := net.ParseIP(host)
+		return err == nil && ip != nil && cidr.Contains(ip)
+	default:
+		if _, _, err := net.SplitHostPort(pattern); err == nil {
+			return pattern == addr
+		}
+		return strings.Trim(pattern, "[]") == host
+	}
+}
+
+// parseNets parses IPs and CIDRs, an IP is a network of itself
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %q", s)
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func matchHosts(patterns []string, addr string) bool {
+	for _, p := range patterns {
+		if matchHost(p, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenBucket limits the rate of bytes, waiters are served in the order they arrive
+// and nobody holds the bucket while waiting
 type TokenBucket struct {
 	Speed int64 // bytes per second
 
-	capacity    int64 // bytes
-	maxCapacity int64
-	lastConsume time.Time
+	tokens      float64 // negative if waiters have reserved tokens in the future
+	maxCapacity int64   // burst
+	last        time.Time
 
 	mu sync.Mutex
 }
@@ -32,40 +95,61 @@ type TokenBucket struct {
 func NewTokenBucket(speed, max int64) *TokenBucket {
 	return &TokenBucket{
 		Speed:       speed,
-		lastConsume: time.Now(),
+		last:        time.Now(),
 		maxCapacity: max,
 	}
 }
 
-func (tb *TokenBucket) Consume(n int64) {
+// reserve takes n tokens at now and returns how long to wait until they are available
+func (tb *TokenBucket) reserve(n int64, now time.Time) time.Duration {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
-	now := time.Now()
-
-	if tb.Speed == 0 {
-		tb.lastConsume = now
-		return
+	if tb.Speed <= 0 {
+		tb.last = now
+		return 0
 	}
 
-	ms := now.Sub(tb.lastConsume).Nanoseconds() / 1e6
-	tb.capacity += ms * tb.Speed / 1000
+	tb.tokens += now.Sub(tb.last).Seconds() * float64(tb.Speed)
+	if max := float64(tb.maxCapacity); tb.tokens > max {
+		tb.tokens = max
+	}
+	tb.last = now
 
-	if tb.capacity > tb.maxCapacity {
-		tb.capacity = tb.maxCapacity
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
 	}
+	return time.Duration(-tb.tokens / float64(tb.Speed) * float64(time.Second))
+}
 
-	if n <= tb.capacity {
-		tb.lastConsume = now
-		tb.capacity -= n
-		return
+// WaitN waits until n tokens are available or ctx is done, in which case the tokens are returned
+func (tb *TokenBucket) WaitN(ctx context.Context, n int64) error {
+	d := tb.reserve(n, time.Now())
+	if d <= 0 {
+		return nil
 	}
 
-	sec := float64(n-tb.capacity) / float64(tb.Speed)
-	time.Sleep(time.Duration(sec*1000) * time.Millisecond)
+	t := time.NewTimer(d)
+	defer t.Stop()
 
-	tb.capacity = 0
-	tb.lastConsume = time.Now()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		tb.mu.Lock()
+		tb.tokens += float64(n)
+		if max := float64(tb.maxCapacity); tb.tokens > max {
+			tb.tokens = max
+		}
+		tb.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Consume waits until n tokens are available
+func (tb *TokenBucket) Consume(n int64) {
+	tb.WaitN(context.Background(), n)
 }
 
 type Traffic struct {
@@ -90,3 +174,112 @@ func (t *Traffic) Recv() *int64 {
 	}
 	return &t.received
 }
+
+// closerSet tracks active connections and listeners so they can be waited for and closed on shutdown,
+// connections can be described by ConnInfo to be listed
+type closerSet struct {
+	mu      sync.Mutex
+	m       map[io.Closer]*ConnInfo
+	closing bool
+	counter uint64
+}
+
+// add adds c to the set, it returns false if the set is closing
+func (s *closerSet) add(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.m == nil {
+		s.m = map[io.Closer]*ConnInfo{}
+	}
+	s.m[c] = nil
+	return true
+}
+
+// describe attaches info to c which has been added, info.ID will be assigned
+func (s *closerSet) describe(c io.Closer, info *ConnInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[c]; ok {
+		s.counter++
+		info.ID = s.counter
+		s.m[c] = info
+	}
+}
+
+func (s *closerSet) remove(c io.Closer) {
+	s.mu.Lock()
+	delete(s.m, c)
+	s.mu.Unlock()
+}
+
+func (s *closerSet) list() []ConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]ConnInfo, 0, len(s.m))
+	for _, info := range s.m {
+		if info != nil {
+			conns = append(conns, info.snapshot())
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// closeWhere closes described closers matching f and returns the number of them
+func (s *closerSet) closeWhere(f func(*ConnInfo) bool) int {
+	s.mu.Lock()
+	var cs []io.Closer
+	for c, info := range s.m {
+		if info != nil && f(info) {
+			cs = append(cs, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range cs {
+		c.Close()
+	}
+	return len(cs)
+}
+
+func (s *closerSet) closeAll() {
+	s.mu.Lock()
+	s.closing = true
+	m := s.m
+	s.m = nil
+	s.mu.Unlock()
+
+	for c := range m {
+		c.Close()
+	}
+}
+
+// drain refuses new closers and waits for existing ones to be removed, then closes the rest if ctx is done
+func (s *closerSet) drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	for tick := time.NewTicker(100 * time.Millisecond); ; {
+		s.mu.Lock()
+		n := len(s.m)
+		s.mu.Unlock()
+
+		if n == 0 {
+			tick.Stop()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			tick.Stop()
+			s.closeAll()
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
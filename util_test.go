@@ -0,0 +1,70 @@
+package goflyway
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMatchHost(t *testing.T) {
+	for _, c := range []struct {
+		pattern, addr string
+		ok            bool
+	}{
+		{"*", "example.com:80", true},
+		{"example.com", "example.com:443", true},
+		{"example.com", "www.example.com:443", false},
+		{"example.com:443", "example.com:443", true},
+		{"example.com:443", "example.com:80", false},
+		{"*.example.com", "example.com:80", true},
+		{"*.example.com", "a.b.example.com:80", true},
+		{"*.example.com", "badexample.com:80", false},
+		{"10.0.0.0/8", "10.1.2.3:22", true},
+		{"10.0.0.0/8", "11.1.2.3:22", false},
+		{"::1", "[::1]:22", true},
+		{"[::1]", "[::1]:22", true},
+	} {
+		if matchHost(c.pattern, c.addr) != c.ok {
+			t.Fatal(c.pattern, c.addr, !c.ok)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	tb := NewTokenBucket(1000, 500)
+	t0 := tb.last
+	for _, c := range []struct {
+		n    int64
+		at   time.Duration
+		wait time.Duration
+	}{
+		{100, 0, 100 * time.Millisecond},
+		{100, 0, 200 * time.Millisecond}, // waiters are served in order
+		{0, 50 * time.Millisecond, 150 * time.Millisecond},
+		{0, time.Second, 0},
+		{600, time.Second, 100 * time.Millisecond}, // burst is capped
+		{-600, time.Second, 0},                     // tokens returned by a cancelled waiter
+		{500, time.Second, 0},
+	} {
+		if d := tb.reserve(c.n, t0.Add(c.at)); d < c.wait-time.Millisecond || d > c.wait+time.Millisecond {
+			t.Fatal(c.n, c.at, d)
+		}
+	}
+
+	tb = NewTokenBucket(1000, 1000)
+	start := time.Now()
+	tb.Consume(100)
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatal(d)
+	}
+
+	// cancelled tokens are returned, so the next waiter is not delayed by them
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tb.WaitN(ctx, 10000); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if tb.reserve(0, tb.last) != 0 {
+		t.Fatal(tb.tokens)
+	}
+}